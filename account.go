@@ -0,0 +1,208 @@
+package gopilot
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Account is an upstream GitHub account whose ghu_ token is exchanged for
+// Copilot tokens.
+type Account struct {
+	ID        string    `json:"id"`
+	Login     string    `json:"login,omitempty"`
+	Token     string    `json:"token"`
+	SKU       string    `json:"sku,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Disabled  bool      `json:"disabled,omitempty"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+
+	inFlight atomic.Int64
+	outcomes outcomeWindow
+}
+
+// begin marks a request as in flight on the account. The returned func must
+// be called once the request is done, reporting whether it failed.
+func (a *Account) begin() func(failed bool) {
+	a.inFlight.Add(1)
+	return func(failed bool) {
+		a.inFlight.Add(-1)
+		a.outcomes.add(failed)
+	}
+}
+
+// inGroup reports whether the account belongs to group. Callers must hold
+// store.mu.
+func (a *Account) inGroup(group string) bool {
+	for _, g := range a.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// inGroups reports whether the account belongs to every non-empty group.
+// Callers must hold store.mu.
+func (a *Account) inGroups(groups []string) bool {
+	for _, g := range groups {
+		if g != "" && !a.inGroup(g) {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshInfo looks up the GitHub login and Copilot SKU of the account.
+func (a *Account) refreshInfo() error {
+	token := store.accountToken(a)
+	login, err := githubLogin(token)
+	if err != nil {
+		return err
+	}
+	sku := checkGhuToken(token)
+	return store.updateAccount(a, func(a *Account) {
+		a.Login = login
+		a.SKU = sku
+	})
+}
+
+// outcomeWindowSize is how far back the per-account error rate looks.
+const outcomeWindowSize = 5 * time.Minute
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+type outcomeWindow struct {
+	mu     sync.Mutex
+	events []outcome
+}
+
+func (o *outcomeWindow) add(failed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.trim()
+	o.events = append(o.events, outcome{time.Now(), failed})
+}
+
+func (o *outcomeWindow) counts() (total, failed int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.trim()
+	for _, e := range o.events {
+		if e.failed {
+			failed++
+		}
+	}
+	return len(o.events), failed
+}
+
+func (o *outcomeWindow) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = nil
+}
+
+func (o *outcomeWindow) trim() {
+	cutoff := time.Now().Add(-outcomeWindowSize)
+	i := 0
+	for i < len(o.events) && o.events[i].at.Before(cutoff) {
+		i++
+	}
+	o.events = o.events[i:]
+}
+
+// ClientKey is an API key handed out to clients of the proxy. Once any key
+// exists, requests must present one unless they bring their own ghu_ token.
+type ClientKey struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"`
+	Key      string `json:"key"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Truncate is the context window mode for the key's requests.
+	Truncate string `json:"truncate,omitempty"`
+	// Cache is the response cache mode for the key's requests.
+	Cache string `json:"cache,omitempty"`
+	// Group limits the key to pool accounts in this group, as with the
+	// keys /auth issues for the account that signed in.
+	Group     string    `json:"group,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (k *ClientKey) matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.Key), []byte(secret)) == 1
+}
+
+var errNoAccount = errors.New("no upstream account available")
+
+// credential is the GitHub token serving one request, with the pool account
+// and client key it came from when there is one.
+type credential struct {
+	key     *ClientKey
+	account *Account
+	token   string
+}
+
+// authorize works out which GitHub token should serve the request.
+//
+// A valid client key always gets a pool account, from group if one is given
+// and from the key's own group if it has one. Without keys configured the
+// pool serves everyone, and callers passing their own gh token are used
+// as-is when the pool is empty.
+func authorize(r *http.Request, group string) (*credential, error) {
+	bearer := bearerToken(r)
+
+	key, disabled := store.findKey(bearer)
+	switch {
+	case key != nil && disabled:
+		return nil, errors.New("api key is disabled")
+	case key != nil:
+	case store.hasKeys() && strings.HasPrefix(bearer, "gh"):
+		return &credential{token: bearer}, nil
+	case store.hasKeys():
+		return nil, errors.New("invalid api key")
+	}
+
+	groups := []string{group}
+	if key != nil && key.Group != "" {
+		groups = append(groups, key.Group)
+	}
+	if account, token := store.pickAccount(groups...); account != nil {
+		return &credential{key: key, account: account, token: token}, nil
+	}
+	if key == nil && strings.HasPrefix(bearer, "gh") {
+		return &credential{token: bearer}, nil
+	}
+	var named []string
+	for _, g := range groups {
+		if g != "" {
+			named = append(named, strconv.Quote(g))
+		}
+	}
+	if len(named) > 0 {
+		return nil, fmt.Errorf("%w in group %s", errNoAccount, strings.Join(named, " and "))
+	}
+	return nil, errNoAccount
+}
+
+// bearerToken reads the caller's token from Authorization, or from api-key
+// as sent by Azure OpenAI clients.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return strings.TrimSpace(r.Header.Get("api-key"))
+	}
+	if i := strings.IndexByte(auth, ' '); i >= 0 {
+		auth = auth[i+1:]
+	}
+	return strings.TrimSpace(auth)
+}
@@ -0,0 +1,78 @@
+package gopilot
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// useStore gives one test an empty store of its own.
+func useStore(t *testing.T) {
+	t.Helper()
+	old := store
+	store = &Store{}
+	if err := store.load(filepath.Join(t.TempDir(), "gopilot.json")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store = old })
+}
+
+func TestAuthorizeKeyGroup(t *testing.T) {
+	useStore(t)
+	alice := &Account{Token: "ghu_alice", Login: "alice", Groups: []string{"auth:alice", "team"}}
+	bob := &Account{Token: "ghu_bob", Login: "bob", Groups: []string{"team"}}
+	for _, a := range []*Account{alice, bob} {
+		if err := store.addAccount(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.addKey("admin"); err != nil {
+		t.Fatal(err)
+	}
+	scoped, err := store.ensureKey("auth:alice", "auth:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := store.keys()[0]
+
+	tests := []struct {
+		name  string
+		key   *ClientKey
+		group string
+		want  []string // accounts that may serve it, none when refused
+	}{
+		{"unscoped key", admin, "", []string{"ghu_alice", "ghu_bob"}},
+		{"scoped key", scoped, "", []string{"ghu_alice"}},
+		{"scoped key and route group", scoped, "team", []string{"ghu_alice"}},
+		{"scoped key outside the route group", scoped, "other", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[string]bool{}
+			for i := 0; i < 8; i++ {
+				r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+				r.Header.Set("Authorization", "Bearer "+tt.key.Key)
+				cred, err := authorize(r, tt.group)
+				if tt.want == nil {
+					if !errors.Is(err, errNoAccount) {
+						t.Fatalf("authorize = %v, want %v", err, errNoAccount)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				seen[cred.token] = true
+			}
+			if len(seen) != len(tt.want) {
+				t.Errorf("served by %v, want %v", seen, tt.want)
+			}
+			for _, token := range tt.want {
+				if !seen[token] {
+					t.Errorf("%s never served, want %v", token, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package gopilot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var adminToken = GetEnvOrDefault("ADMIN_TOKEN", "")
+
+// authRegister makes a successful /auth/check add the token to the account
+// pool; authIssueKey additionally answers with the account's client key
+// instead of the token itself.
+var authRegister = os.Getenv("AUTH_REGISTER") != "" || authIssueKey
+var authIssueKey = os.Getenv("AUTH_ISSUE_KEY") != ""
+
+var startedAt = time.Now()
+
+// accountView is what the admin API shows for an account. The token itself
+// is masked.
+type accountView struct {
+	ID              string     `json:"id"`
+	Login           string     `json:"login"`
+	Token           string     `json:"token"`
+	SKU             string     `json:"sku"`
+	Groups          []string   `json:"groups"`
+	Source          string     `json:"source"`
+	Disabled        bool       `json:"disabled"`
+	CreatedAt       time.Time  `json:"created_at"`
+	TokenExpiresAt  *time.Time `json:"copilot_token_expires_at"`
+	InFlight        int64      `json:"in_flight"`
+	RecentRequests  int        `json:"recent_requests"`
+	RecentErrors    int        `json:"recent_errors"`
+	RecentErrorRate float64    `json:"recent_error_rate"`
+}
+
+func viewAccount(a *Account) accountView {
+	store.mu.RLock()
+	token := a.Token
+	v := accountView{
+		ID:        a.ID,
+		Login:     a.Login,
+		Token:     maskSecret(a.Token),
+		SKU:       a.SKU,
+		Groups:    append([]string{}, a.Groups...),
+		Source:    a.Source,
+		Disabled:  a.Disabled,
+		CreatedAt: a.CreatedAt,
+		InFlight:  a.inFlight.Load(),
+	}
+	store.mu.RUnlock()
+
+	if cached, found := cachedAccToken(token); found {
+		v.TokenExpiresAt = &cached.ExpiresAt
+	}
+	v.RecentRequests, v.RecentErrors = a.outcomes.counts()
+	if v.RecentRequests > 0 {
+		v.RecentErrorRate = float64(v.RecentErrors) / float64(v.RecentRequests)
+	}
+	return v
+}
+
+type keyView struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Key       string    `json:"key"`
+	Disabled  bool      `json:"disabled"`
+	Truncate  string    `json:"truncate"`
+	Cache     string    `json:"cache"`
+	Group     string    `json:"group"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func viewKey(k *ClientKey) keyView {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return keyView{
+		ID:        k.ID,
+		Name:      k.Name,
+		Key:       maskSecret(k.Key),
+		Disabled:  k.Disabled,
+		Truncate:  k.Truncate,
+		Cache:     k.Cache,
+		Group:     k.Group,
+		CreatedAt: k.CreatedAt,
+	}
+}
+
+// adminHandler serves the /admin API. It is only enabled when ADMIN_TOKEN is
+// set, and every request must carry it as a bearer token.
+//
+//	GET    /admin/state
+//	GET    /admin/accounts
+//	POST   /admin/accounts                  {"token": "ghu_..."}
+//	GET    /admin/accounts/{id}
+//	DELETE /admin/accounts/{id}
+//	POST   /admin/accounts/{id}/enable|disable|refresh|clear
+//	POST   /admin/accounts/{id}/groups       {"groups": ["paid"]}
+//	GET    /admin/keys
+//	POST   /admin/keys                      {"name": "ci"}
+//	DELETE /admin/keys/{id}
+//	POST   /admin/keys/{id}/enable|disable
+//	POST   /admin/keys/{id}/truncate         {"truncate": "middle-out"}
+//	POST   /admin/keys/{id}/cache            {"cache": "on"}
+//	GET    /admin/routes
+//	POST   /admin/routes/reload
+func adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/"), "/")
+		switch parts[0] {
+		case "state":
+			adminState(w, r)
+		case "accounts":
+			adminAccounts(w, r, parts[1:])
+		case "keys":
+			adminKeys(w, r, parts[1:])
+		case "routes":
+			adminRoutes(w, r, parts[1:])
+		default:
+			writeError(w, http.StatusNotFound, "unknown admin route")
+		}
+	})
+}
+
+func adminState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	accounts := []accountView{}
+	var inFlight int64
+	for _, a := range store.accounts() {
+		v := viewAccount(a)
+		inFlight += v.InFlight
+		accounts = append(accounts, v)
+	}
+	keys := []keyView{}
+	for _, k := range store.keys() {
+		keys = append(keys, viewKey(k))
+	}
+	writeResult(w, map[string]interface{}{
+		"started_at": startedAt,
+		"uptime":     time.Since(startedAt).Round(time.Second).String(),
+		"in_flight":  inFlight,
+		"accounts":   accounts,
+		"keys":       keys,
+	})
+}
+
+func adminAccounts(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []accountView{}
+			for _, a := range store.accounts() {
+				list = append(list, viewAccount(a))
+			}
+			writeResult(w, list)
+		case http.MethodPost:
+			var body struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, "body must be JSON")
+				return
+			}
+			a, err := registerAccount(body.Token, "admin")
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeResult(w, viewAccount(a))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	a := store.findAccount(parts[0])
+	if a == nil {
+		writeError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeResult(w, viewAccount(a))
+	case action == "" && r.Method == http.MethodDelete:
+		if err := store.removeAccount(a.ID); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeResult(w, "")
+	case action == "enable" && r.Method == http.MethodPost,
+		action == "disable" && r.Method == http.MethodPost:
+		if err := store.setAccountDisabled(a.ID, action == "disable"); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeResult(w, viewAccount(a))
+	case action == "refresh" && r.Method == http.MethodPost:
+		token := store.accountToken(a)
+		clearAccToken(token)
+		if _, err := getAccToken(token); err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if err := a.refreshInfo(); err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeResult(w, viewAccount(a))
+	case action == "groups" && r.Method == http.MethodPost:
+		var body struct {
+			Groups []string `json:"groups"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be JSON")
+			return
+		}
+		err := store.updateAccount(a, func(a *Account) {
+			a.Groups = body.Groups
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeResult(w, viewAccount(a))
+	case action == "clear" && r.Method == http.MethodPost:
+		clearAccToken(store.accountToken(a))
+		a.outcomes.reset()
+		writeResult(w, viewAccount(a))
+	default:
+		writeError(w, http.StatusNotFound, "unknown account action")
+	}
+}
+
+func adminKeys(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			list := []keyView{}
+			for _, k := range store.keys() {
+				list = append(list, viewKey(k))
+			}
+			writeResult(w, list)
+		case http.MethodPost:
+			var body struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, "body must be JSON")
+				return
+			}
+			k, err := store.addKey(body.Name)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			// The only time the full key is shown
+			v := viewKey(k)
+			v.Key = k.Key
+			writeResult(w, v)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	id := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		err = store.removeKey(id)
+	case action == "enable" && r.Method == http.MethodPost,
+		action == "disable" && r.Method == http.MethodPost:
+		err = store.setKeyDisabled(id, action == "disable")
+	case action == "truncate" && r.Method == http.MethodPost:
+		var body struct {
+			Truncate string `json:"truncate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !validTruncateMode(body.Truncate) {
+			writeError(w, http.StatusBadRequest, "truncate must be off, middle-out or summarize")
+			return
+		}
+		err = store.updateKey(id, func(k *ClientKey) {
+			k.Truncate = body.Truncate
+		})
+	case action == "cache" && r.Method == http.MethodPost:
+		var body struct {
+			Cache string `json:"cache"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !validCacheMode(body.Cache) {
+			writeError(w, http.StatusBadRequest, "cache must be on, off or empty")
+			return
+		}
+		err = store.updateKey(id, func(k *ClientKey) {
+			k.Cache = body.Cache
+		})
+	default:
+		writeError(w, http.StatusNotFound, "unknown key action")
+		return
+	}
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeResult(w, "")
+}
+
+func adminRoutes(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+	case len(parts) == 1 && parts[0] == "reload" && r.Method == http.MethodPost:
+		if err := routes.reload(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, "unknown routes action")
+		return
+	}
+	list := routes.list()
+	if list == nil {
+		list = []*routeRule{}
+	}
+	writeResult(w, list)
+}
+
+// registerAccount validates a ghu_ token against Copilot and adds it to the
+// pool.
+func registerAccount(token, source string) (*Account, error) {
+	if !strings.HasPrefix(token, "gh") {
+		return nil, errors.New("ghu 格式错误")
+	}
+	if _, err := getAccToken(token); err != nil {
+		return nil, err
+	}
+	login, err := githubLogin(token)
+	if err != nil {
+		return nil, err
+	}
+	a := &Account{
+		Login:  login,
+		Token:  token,
+		SKU:    checkGhuToken(token),
+		Source: source,
+	}
+	if err := store.addAccount(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// registerAuthToken adds a token obtained through the /auth device flow to
+// the pool. With AUTH_ISSUE_KEY set it also returns the account's client
+// key, minted on its first sign-in, so the caller never needs the raw GitHub
+// token. The key is limited to an auth:<login> group holding just that
+// account, so signing in doesn't open up the rest of the pool. Keys are
+// only issued once the admin has created one: until then the server is open
+// and the token is returned as with AUTH_REGISTER.
+func registerAuthToken(token string) (string, error) {
+	a, err := registerAccount(token, "auth")
+	var dup *duplicateAccountError
+	if errors.As(err, &dup) {
+		a, err = dup.account, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	store.mu.RLock()
+	login, sku := a.Login, a.SKU
+	store.mu.RUnlock()
+	log.Printf("registered account %s (%s, %s) from /auth", a.ID, login, sku)
+
+	if !authIssueKey {
+		return "", nil
+	}
+	group := "auth:" + login
+	k, err := store.ensureKey(group, group)
+	if err != nil {
+		return "", err
+	}
+	if k == nil {
+		log.Println("AUTH_ISSUE_KEY 未生效：还没有 API key，服务处于开放模式")
+		return "", nil
+	}
+	if k.Disabled {
+		return "", fmt.Errorf("the api key of %s is disabled", login)
+	}
+	err = store.updateAccount(a, func(a *Account) {
+		if !a.inGroup(group) {
+			a.Groups = append(a.Groups, group)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return k.Key, nil
+}
+
+// writeResult and writeError use the same envelope as the /auth endpoints.
+func writeResult(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": "0",
+		"msg":  "success",
+		"data": data,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": "1",
+		"msg":  msg,
+		"data": "",
+	})
+}
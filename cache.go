@@ -0,0 +1,418 @@
+package gopilot
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache modes, chosen by the X-Gopilot-Cache request header, else the
+// client key. By default only deterministic requests are cached: chat with
+// temperature 0, and embeddings.
+const (
+	cacheAuto = ""
+	cacheOn   = "on"
+	cacheOff  = "off"
+)
+
+func validCacheMode(mode string) bool {
+	switch mode {
+	case cacheAuto, cacheOn, cacheOff:
+		return true
+	}
+	return false
+}
+
+// cacheBackend stores answers by request hash.
+type cacheBackend interface {
+	get(key string) ([]byte, bool)
+	put(key string, value []byte)
+}
+
+// responseCache is the backend picked by CACHE, nil when caching is off.
+var responseCache cacheBackend
+
+// loadResponseCache sets up the cache from CACHE=memory|disk, CACHE_DIR,
+// CACHE_TTL and CACHE_MAX_SIZE.
+func loadResponseCache() error {
+	kind := os.Getenv("CACHE")
+	if kind == "" {
+		responseCache = nil
+		return nil
+	}
+	ttl, err := time.ParseDuration(GetEnvOrDefault("CACHE_TTL", "24h"))
+	if err != nil {
+		return fmt.Errorf("CACHE_TTL: %w", err)
+	}
+	maxSize, err := parseSize(GetEnvOrDefault("CACHE_MAX_SIZE", "100MB"))
+	if err != nil {
+		return fmt.Errorf("CACHE_MAX_SIZE: %w", err)
+	}
+	switch kind {
+	case "memory":
+		responseCache = newMemoryCache(ttl, maxSize)
+	case "disk":
+		dir := GetEnvOrDefault("CACHE_DIR", "cache")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("CACHE_DIR: %w", err)
+		}
+		responseCache = &diskCache{dir: dir, ttl: ttl, maxSize: maxSize}
+	default:
+		return fmt.Errorf("CACHE: unknown backend %q, want memory or disk", kind)
+	}
+	return nil
+}
+
+// cacheMode picks the cache mode of a request.
+func cacheMode(r *http.Request, cred *credential) string {
+	if mode := r.Header.Get("X-Gopilot-Cache"); mode != "" {
+		return mode
+	}
+	if cred.key != nil {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		return cred.key.Cache
+	}
+	return cacheAuto
+}
+
+// cacheKey hashes a request, or returns "" if it shouldn't be cached.
+func cacheKey(mode, url, model string, body map[string]interface{}) string {
+	if responseCache == nil || mode == cacheOff {
+		return ""
+	}
+	if mode == cacheAuto && url == completionsUrl {
+		if t, ok := body["temperature"].(float64); !ok || t != 0 {
+			return ""
+		}
+	}
+	return requestHash(url, model, body)
+}
+
+// requestHash hashes a request body with the upstream model and without the
+// fields that don't change the answer, so a stream can be replayed from a
+// stored completion.
+func requestHash(url, model string, body map[string]interface{}) string {
+	normalized := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		switch k {
+		case "stream", "stream_options", "user":
+			continue
+		}
+		normalized[k] = v
+	}
+	normalized["model"] = model
+	// Maps are encoded with sorted keys, so equal bodies hash the same.
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(url+"\n"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedAnswer is a stored answer and the model that gave it.
+type cachedAnswer struct {
+	Model string          `json:"model"`
+	Body  json.RawMessage `json:"body"`
+}
+
+func lookupCache(key string) (*cachedAnswer, bool) {
+	if key == "" {
+		return nil, false
+	}
+	data, ok := responseCache.get(key)
+	if !ok {
+		return nil, false
+	}
+	var a cachedAnswer
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, false
+	}
+	return &a, true
+}
+
+func storeCache(key, model string, body []byte) {
+	if key == "" || body == nil {
+		return
+	}
+	data, err := json.Marshal(cachedAnswer{Model: model, Body: body})
+	if err != nil {
+		return
+	}
+	responseCache.put(key, data)
+}
+
+// replayChatStream sends a stored chat completion as a stream: one chunk
+// with each choice's message, one with its finish reason, and the usage
+// chunk if the client asked for it.
+func replayChatStream(w http.ResponseWriter, body []byte, norm *chatNormalizer) error {
+	var cc chatCompletion
+	if err := json.Unmarshal(body, &cc); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	norm.started = true
+	norm.id, norm.created, norm.model = cc.ID, cc.Created, cc.Model
+	norm.usage = cc.Usage
+
+	for _, choice := range cc.Choices {
+		delta := choice.Message
+		if delta == nil {
+			delta = &responseMessage{Role: "assistant"}
+		}
+		for i := range delta.ToolCalls {
+			index := i
+			delta.ToolCalls[i].Index = &index
+		}
+		chunks := []chatChoice{
+			{Index: choice.Index, Delta: delta},
+			{Index: choice.Index, Delta: &responseMessage{}, FinishReason: choice.FinishReason},
+		}
+		for _, c := range chunks {
+			if c.Delta.Content == nil {
+				empty := ""
+				c.Delta.Content = &empty
+			}
+			chunk := chatCompletion{Choices: []chatChoice{c}}
+			norm.fill(&chunk, "chat.completion.chunk")
+			nullLogprobs(&chunk.Choices[0])
+			data, err := json.Marshal(chunk)
+			if err != nil {
+				return err
+			}
+			if err := norm.emit(w, data); err != nil {
+				return err
+			}
+		}
+	}
+	if usage, err := norm.usageChunk(); err != nil {
+		return err
+	} else if usage != nil {
+		norm.emit(w, usage)
+	}
+	_, err := w.Write([]byte("data: [DONE]\n\n"))
+	return err
+}
+
+// memoryCache is an LRU of answers capped at maxSize bytes.
+type memoryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	storeAt time.Time
+}
+
+func newMemoryCache(ttl time.Duration, maxSize int64) *memoryCache {
+	return &memoryCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *memoryCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryEntry)
+	if c.ttl > 0 && time.Since(e.storeAt) > c.ttl {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *memoryCache) put(key string, value []byte) {
+	if c.maxSize > 0 && int64(len(value)) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&memoryEntry{key: key, value: value, storeAt: time.Now()})
+	c.size += int64(len(value))
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*memoryEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.value))
+}
+
+// diskCache keeps one file per answer in dir. Expired files are removed
+// when read; the size cap is enforced in the background at most once a
+// minute, oldest files first.
+type diskCache struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+
+	mu      sync.Mutex
+	last    time.Time
+	running bool
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *diskCache) get(key string) ([]byte, bool) {
+	p := c.path(key)
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Since(info.ModTime()) > c.ttl {
+		os.Remove(p)
+		return nil, false
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *diskCache) put(key string, value []byte) {
+	// Write then rename so readers never see half a file.
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		log.Println("Cache write error:", err)
+		return
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Println("Cache write error:", err)
+		return
+	}
+	c.maybePrune()
+}
+
+func (c *diskCache) maybePrune() {
+	c.mu.Lock()
+	if c.running || time.Since(c.last) < time.Minute {
+		c.mu.Unlock()
+		return
+	}
+	c.running = true
+	c.mu.Unlock()
+
+	go c.prune()
+}
+
+func (c *diskCache) prune() {
+	defer func() {
+		c.mu.Lock()
+		c.running = false
+		c.last = time.Now()
+		c.mu.Unlock()
+	}()
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Println("Cache prune error:", err)
+		return
+	}
+	for _, d := range entries {
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		p := filepath.Join(c.dir, d.Name())
+		if c.ttl > 0 && time.Since(info.ModTime()) > c.ttl {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Println("Cache prune error:", err)
+			}
+			continue
+		}
+		files = append(files, file{p, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	if c.maxSize <= 0 || total <= c.maxSize {
+		return
+	}
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].modTime.Before(files[b].modTime)
+	})
+	for _, f := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Cache prune error:", err)
+			continue
+		}
+		total -= f.size
+	}
+}
+
+// serveCached answers a request from the cache, reporting false if the
+// stored answer can't be used.
+func serveCached(w http.ResponseWriter, hit *cachedAnswer, isStream bool, norm *chatNormalizer) bool {
+	w.Header().Set("X-Gopilot-Cache", "hit")
+	w.Header().Set("X-Gopilot-Model", hit.Model)
+	if isStream {
+		var cc chatCompletion
+		if json.Unmarshal(hit.Body, &cc) != nil {
+			w.Header().Set("X-Gopilot-Cache", "miss")
+			return false
+		}
+		if err := replayChatStream(w, hit.Body, norm); err != nil {
+			log.Println("Error replaying stream:", err)
+		}
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(hit.Body)
+	return true
+}
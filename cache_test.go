@@ -0,0 +1,44 @@
+package gopilot
+
+import "testing"
+
+func TestRequestHash(t *testing.T) {
+	base := func() map[string]interface{} {
+		return map[string]interface{}{
+			"model":       "gpt-4",
+			"temperature": 0.0,
+			"messages":    []interface{}{map[string]interface{}{"role": "user", "content": "hi"}},
+		}
+	}
+	with := func(k string, v interface{}) map[string]interface{} {
+		body := base()
+		body[k] = v
+		return body
+	}
+	want := requestHash(completionsUrl, "gpt-4o", base())
+
+	tests := []struct {
+		name  string
+		url   string
+		model string
+		body  map[string]interface{}
+		same  bool
+	}{
+		{"stream", completionsUrl, "gpt-4o", with("stream", true), true},
+		{"stream_options", completionsUrl, "gpt-4o", with("stream_options", map[string]interface{}{"include_usage": true}), true},
+		{"user", completionsUrl, "gpt-4o", with("user", "alice"), true},
+		{"requested model", completionsUrl, "gpt-4o", with("model", "gpt-4-0613"), true},
+		{"upstream model", completionsUrl, "gpt-4o-mini", base(), false},
+		{"url", embeddingsUrl, "gpt-4o", base(), false},
+		{"temperature", completionsUrl, "gpt-4o", with("temperature", 0.5), false},
+		{"messages", completionsUrl, "gpt-4o", with("messages", []interface{}{}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requestHash(tt.url, tt.model, tt.body)
+			if (got == want) != tt.same {
+				t.Errorf("hash equal = %v, want %v", got == want, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package gopilot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const modelsUrl = "https://api.githubcopilot.com/models"
+
+// catalogTTL is how long the upstream model list is trusted before it is
+// fetched again.
+const catalogTTL = time.Hour
+
+// CatalogModel is a model as reported by Copilot's /models endpoint, reduced
+// to the fields the proxy acts on.
+type CatalogModel struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	Vendor           string `json:"vendor"`
+	Version          string `json:"version"`
+	Family           string `json:"family"`
+	Type             string `json:"type"`
+	Tokenizer        string `json:"tokenizer"`
+	MaxContextTokens int    `json:"max_context_window_tokens"`
+	MaxPromptTokens  int    `json:"max_prompt_tokens"`
+	MaxOutputTokens  int    `json:"max_output_tokens"`
+	MaxInputs        int    `json:"max_inputs"`
+	Streaming        bool   `json:"streaming"`
+	ToolCalls        bool   `json:"tool_calls"`
+	Vision           bool   `json:"vision"`
+	// StructuredOutputs is support for response_format json_schema.
+	StructuredOutputs bool `json:"structured_outputs"`
+}
+
+type modelCatalog struct {
+	mu         sync.Mutex
+	models     []CatalogModel
+	fetchedAt  time.Time
+	err        error
+	refreshing bool
+}
+
+var catalog = &modelCatalog{}
+
+// list returns the cached catalog, kicking off a background refresh when it
+// is stale.
+func (c *modelCatalog) list() []CatalogModel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := time.Since(c.fetchedAt) > catalogTTL
+	if c.err != nil {
+		stale = time.Since(c.fetchedAt) > time.Minute
+	}
+	if stale && !c.refreshing {
+		c.refreshing = true
+		go c.refresh()
+	}
+	return c.models
+}
+
+// lookup finds a model by ID in the cached catalog.
+func (c *modelCatalog) lookup(id string) (CatalogModel, bool) {
+	for _, m := range c.list() {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return CatalogModel{}, false
+}
+
+// state reports when the catalog was last fetched and the last error, if any.
+func (c *modelCatalog) state() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetchedAt, c.err
+}
+
+// refresh fetches the model list from Copilot using any pool account.
+func (c *modelCatalog) refresh() error {
+	models, err := fetchCatalog()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	c.fetchedAt = time.Now()
+	c.err = err
+	if err != nil {
+		log.Println("model catalog refresh failed:", err)
+		return err
+	}
+	c.models = models
+	return nil
+}
+
+func fetchCatalog() ([]CatalogModel, error) {
+	account, token := store.pickAccount()
+	if account == nil {
+		return nil, errNoAccount
+	}
+	accToken, err := getAccToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", modelsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range copilotHeaders(accToken) {
+		req.Header.Add(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取模型列表失败：%d, %s", resp.StatusCode, body)
+	}
+
+	data := gjson.GetBytes(body, "data")
+	if !data.IsArray() {
+		return nil, errors.New("model list missing data")
+	}
+	var models []CatalogModel
+	for _, m := range data.Array() {
+		caps := m.Get("capabilities")
+		models = append(models, CatalogModel{
+			ID:                m.Get("id").String(),
+			Name:              m.Get("name").String(),
+			Vendor:            m.Get("vendor").String(),
+			Version:           m.Get("version").String(),
+			Family:            caps.Get("family").String(),
+			Type:              caps.Get("type").String(),
+			Tokenizer:         caps.Get("tokenizer").String(),
+			MaxContextTokens:  int(caps.Get("limits.max_context_window_tokens").Int()),
+			MaxPromptTokens:   int(caps.Get("limits.max_prompt_tokens").Int()),
+			MaxOutputTokens:   int(caps.Get("limits.max_output_tokens").Int()),
+			MaxInputs:         int(caps.Get("limits.max_inputs").Int()),
+			Streaming:         caps.Get("supports.streaming").Bool(),
+			ToolCalls:         caps.Get("supports.tool_calls").Bool(),
+			Vision:            caps.Get("supports.vision").Bool(),
+			StructuredOutputs: caps.Get("supports.structured_outputs").Bool(),
+		})
+	}
+	return models, nil
+}
@@ -0,0 +1,287 @@
+package gopilot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+var defaultChatModel = GetEnvOrDefault("CHAT_MODEL", "gpt-4o")
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// streamChat sends a chat completion with a pool account, without going
+// through the HTTP server, and writes the answer to out as it arrives.
+func streamChat(ctx context.Context, model string, messages []chatMessage, out io.Writer) (string, error) {
+	cred, err := poolCredential()
+	if err != nil {
+		return "", err
+	}
+	failed := true
+	done := cred.account.begin()
+	defer func() { done(failed) }()
+
+	list := make([]interface{}, len(messages))
+	for i, m := range messages {
+		list[i] = map[string]interface{}{"role": m.Role, "content": m.Content}
+	}
+	jsonBody := map[string]interface{}{
+		"model":    model,
+		"messages": list,
+		"stream":   true,
+	}
+	if _, e := applyGuardrails(jsonBody); e != nil {
+		return "", errors.New(e.Message)
+	}
+	body, err := json.Marshal(jsonBody)
+	if err != nil {
+		return "", err
+	}
+	resp, err := sendUpstream(ctx, cred, completionsUrl, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("对话失败：%d, %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	var answer strings.Builder
+	write := func(delta string) error {
+		answer.WriteString(delta)
+		_, err := io.WriteString(out, delta)
+		return err
+	}
+	guard := newResponseGuard()
+	err = scanSSE(resp.Body, func(data []byte) error {
+		choice := gjson.GetBytes(data, "choices.0")
+		var finish *string
+		if f := choice.Get("finish_reason"); f.Type == gjson.String {
+			s := f.String()
+			finish = &s
+		}
+		delta, finish := guard.text(0, choice.Get("delta.content").String(), finish)
+		if finish != nil && *finish == "content_filter" {
+			return errors.New("回答被 guardrail 拦截")
+		}
+		if delta == "" {
+			return nil
+		}
+		return write(delta)
+	})
+	if err != nil {
+		return answer.String(), err
+	}
+	for _, held := range guard.tail() {
+		if err := write(*held.Delta.Content); err != nil {
+			return answer.String(), err
+		}
+	}
+	failed = false
+	return answer.String(), nil
+}
+
+// chatSession is the state of an interactive chat. The system prompt is kept
+// apart from the history so /system can change it mid-conversation.
+type chatSession struct {
+	Model    string        `json:"model"`
+	System   string        `json:"system,omitempty"`
+	Messages []chatMessage `json:"messages"`
+}
+
+func (s *chatSession) request(prompt string) []chatMessage {
+	var messages []chatMessage
+	if s.System != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: s.System})
+	}
+	messages = append(messages, s.Messages...)
+	return append(messages, chatMessage{Role: "user", Content: prompt})
+}
+
+func (s *chatSession) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (s *chatSession) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var loaded chatSession
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if loaded.Model == "" {
+		loaded.Model = s.Model
+	}
+	*s = loaded
+	return nil
+}
+
+const chatHelp = `Commands:
+  /model [name]    show or switch the model
+  /system [text]   show or set the system prompt, "/system -" clears it
+  /save <file>     save the conversation as JSON
+  /load <file>     load a saved conversation
+  /clear           forget the conversation so far
+  /exit            quit
+Mention @path to attach a file. End a line with \ to continue it.
+`
+
+// runChatREPL reads prompts from in until EOF or /exit. Ctrl-C stops the
+// answer being streamed; at the prompt it exits.
+func runChatREPL(in io.Reader, out io.Writer, s *chatSession) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	fmt.Fprintf(out, "gopilot chat with %s, /help for commands\n", s.Model)
+
+	for {
+		fmt.Fprint(out, "> ")
+		var lines []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasSuffix(line, `\`) {
+				lines = append(lines, line)
+				break
+			}
+			lines = append(lines, strings.TrimSuffix(line, `\`))
+			fmt.Fprint(out, ". ")
+		}
+		if len(lines) == 0 {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		input := strings.TrimSpace(strings.Join(lines, "\n"))
+		if input == "" {
+			continue
+		}
+
+		if strings.HasPrefix(input, "/") {
+			quit, err := s.command(input, out)
+			if err != nil {
+				fmt.Fprintln(out, "error:", err)
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+
+		prompt, err := expandAttachments(input)
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+			continue
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		answer, err := streamChat(ctx, s.Model, s.request(prompt), out)
+		stop()
+		fmt.Fprintln(out)
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+			continue
+		}
+		s.Messages = append(s.Messages,
+			chatMessage{Role: "user", Content: prompt},
+			chatMessage{Role: "assistant", Content: answer})
+	}
+}
+
+// command runs a REPL slash command, reporting whether the REPL should quit.
+func (s *chatSession) command(input string, out io.Writer) (bool, error) {
+	name, arg, _ := strings.Cut(input, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case "/exit", "/quit":
+		return true, nil
+	case "/help":
+		fmt.Fprint(out, chatHelp)
+	case "/model":
+		if arg != "" {
+			s.Model = arg
+		}
+		fmt.Fprintln(out, "model:", s.Model)
+	case "/system":
+		switch arg {
+		case "":
+		case "-":
+			s.System = ""
+		default:
+			s.System = arg
+		}
+		fmt.Fprintf(out, "system: %q\n", s.System)
+	case "/clear":
+		s.Messages = nil
+		fmt.Fprintln(out, "conversation cleared")
+	case "/save":
+		if arg == "" {
+			return false, errors.New("usage: /save <file>")
+		}
+		if err := s.save(arg); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "saved %d messages to %s\n", len(s.Messages), arg)
+	case "/load":
+		if arg == "" {
+			return false, errors.New("usage: /load <file>")
+		}
+		if err := s.load(arg); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "loaded %d messages, model %s\n", len(s.Messages), s.Model)
+	default:
+		return false, fmt.Errorf("unknown command %s, try /help", name)
+	}
+	return false, nil
+}
+
+// expandAttachments appends the content of every @path in the prompt that
+// names a readable file. Other @words are left alone.
+func expandAttachments(prompt string) (string, error) {
+	var attachments strings.Builder
+	seen := map[string]bool{}
+	for _, word := range strings.Fields(prompt) {
+		if !strings.HasPrefix(word, "@") || len(word) == 1 {
+			continue
+		}
+		path := strings.TrimRight(word[1:], ",.;:!?)")
+		if seen[path] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		seen[path] = true
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&attachments, "\n\nFile: %s\n```\n%s\n```", path, strings.TrimRight(string(content), "\n"))
+	}
+	return prompt + attachments.String(), nil
+}
+
+// stdinIsTerminal reports whether stdin is interactive rather than piped.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,472 @@
+package gopilot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Version is set at build time with -ldflags "-X github.com/chadgpt/gopilot.Version=...".
+var Version = "dev"
+
+const usage = `Usage: gopilot [command] [flags]
+
+Commands:
+  serve                      run the proxy server (the default)
+  login                      authorize a GitHub account with the device flow
+  logout [account] [-all]    remove stored accounts
+  accounts list              list upstream accounts
+  accounts group <id> [group...]
+                             set the routing groups of an account
+  token check [ghu_token]    show SKU and Copilot token expiry
+  models [-json]             list the models Copilot offers
+  chat [-model m] [prompt]   chat interactively, or answer one prompt or piped
+                             input and exit
+  keys list|add|enable|disable|truncate|cache|remove
+                             manage client API keys
+  version                    print the version
+
+Accounts come from GHU_TOKEN (comma separated) and the store at STORE_PATH.
+`
+
+// Run starts the server, or runs one of the subcommands listed in usage.
+func Run(args []string) (err error) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			fmt.Print(usage)
+			return nil
+		case "version":
+			fmt.Printf("gopilot %s (%s %s/%s)\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			return nil
+		}
+	}
+
+	if err := store.load(storePath); err != nil {
+		return err
+	}
+	store.addEnvAccounts(ghuToken)
+
+	if len(args) == 0 {
+		return cmdServe(nil)
+	}
+	switch args[0] {
+	case "serve":
+		return cmdServe(args[1:])
+	case "login":
+		return cmdLogin(args[1:])
+	case "logout":
+		return cmdLogout(args[1:])
+	case "accounts":
+		return cmdAccounts(args[1:])
+	case "token":
+		return cmdToken(args[1:])
+	case "models":
+		return cmdModels(args[1:])
+	case "chat":
+		return cmdChat(args[1:])
+	case "keys":
+		return cmdKeys(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
+
+func cmdServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&port, "port", port, "port to listen on")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q\n\n%s", fs.Args(), usage)
+	}
+	if err := loadServerConfig(); err != nil {
+		return err
+	}
+	return serve()
+}
+
+// loadServerConfig reads the configuration only the server uses, so the
+// other commands don't fail on, or wait for, files they never need.
+func loadServerConfig() error {
+	if err := checkTokenizer(); err != nil {
+		return err
+	}
+	if err := routes.load(routesPath); err != nil {
+		return err
+	}
+	if err := loadRequestPolicy(os.Getenv("REQUEST_POLICY")); err != nil {
+		return err
+	}
+	if err := loadResponseCache(); err != nil {
+		return err
+	}
+	if err := loadEmbeddingCache(); err != nil {
+		return err
+	}
+	if err := loadImageConfig(); err != nil {
+		return err
+	}
+	if err := loadGuardrails(guardrailsPath); err != nil {
+		return err
+	}
+	return loadHooks(hooksDir)
+}
+
+func cmdLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q\n\n%s", fs.Args(), usage)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	token, err := deviceLogin(ctx)
+	if err != nil {
+		return err
+	}
+
+	a, err := registerAccount(token, "login")
+	var dup *duplicateAccountError
+	if errors.As(err, &dup) {
+		fmt.Printf("Account %s (%s) is already registered\n", dup.account.ID, dup.account.Login)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in as %s (%s), saved as account %s in %s\n", a.Login, a.SKU, a.ID, storePath)
+	return nil
+}
+
+// deviceLogin runs the device flow on the terminal and returns the ghu_
+// token once the user has approved it.
+func deviceLogin(ctx context.Context) (string, error) {
+	session, err := newDeviceSession()
+	if err != nil {
+		return "", fmt.Errorf("获取设备码失败：%w", err)
+	}
+	fmt.Printf("Open %s and enter the code: %s\n", session.code.VerificationURI, session.code.UserCode)
+	fmt.Println("Waiting for authorization...")
+
+	for {
+		interval, _, _ := session.state()
+		select {
+		case <-ctx.Done():
+			session.cancel()
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		status, token := session.poll()
+		_, _, message := session.state()
+		switch status {
+		case deviceStatusSuccess:
+			return token, nil
+		case deviceStatusPending:
+		case deviceStatusSlowDown:
+			interval, _, _ := session.state()
+			fmt.Printf("GitHub asked to slow down, polling every %s\n", interval)
+		case deviceStatusExpired:
+			return "", errors.New("the device code expired, run login again")
+		case deviceStatusDenied:
+			return "", errors.New("authorization was denied")
+		default:
+			return "", fmt.Errorf("device flow failed: %s", message)
+		}
+	}
+}
+
+func cmdLogout(args []string) error {
+	fs := flag.NewFlagSet("logout", flag.ExitOnError)
+	all := fs.Bool("all", false, "remove every stored account")
+	names := parseFlags(fs, args)
+	if len(names) > 1 || *all && len(names) > 0 {
+		return errors.New("usage: gopilot logout [account] | -all")
+	}
+
+	var stored []*Account
+	for _, a := range store.accounts() {
+		if a.Source != "env" {
+			stored = append(stored, a)
+		}
+	}
+
+	var targets []*Account
+	switch {
+	case *all:
+		targets = stored
+	case len(names) == 1:
+		for _, a := range stored {
+			if a.ID == names[0] || a.Login == names[0] {
+				targets = append(targets, a)
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("no stored account %q", names[0])
+		}
+	case len(stored) == 1:
+		targets = stored
+	case len(stored) == 0:
+		return errors.New("no stored accounts")
+	default:
+		return errors.New("several accounts are stored, name one by ID or login, or pass -all")
+	}
+
+	for _, a := range targets {
+		if err := store.removeAccount(a.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Removed account %s (%s)\n", a.ID, a.Login)
+	}
+	return nil
+}
+
+// parseFlags parses args allowing flags after the positional arguments too,
+// as in `logout alice -all`, and returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func cmdAccounts(args []string) error {
+	if len(args) > 0 && args[0] == "group" {
+		if len(args) < 2 {
+			return errors.New("usage: gopilot accounts group <id> [group...]")
+		}
+		a := store.findAccount(args[1])
+		if a == nil {
+			return fmt.Errorf("no account %q", args[1])
+		}
+		if a.Source == "env" {
+			return fmt.Errorf("account %s comes from GHU_TOKEN; set its groups with /admin/accounts/%s/groups", a.ID, a.ID)
+		}
+		return store.updateAccount(a, func(a *Account) {
+			a.Groups = args[2:]
+		})
+	}
+	if len(args) == 0 || args[0] != "list" {
+		return errors.New("usage: gopilot accounts list|group <id> [group...]")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tLOGIN\tSKU\tSOURCE\tGROUPS\tSTATUS\tTOKEN")
+	for _, a := range store.accounts() {
+		status := "enabled"
+		if a.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", a.ID, dash(a.Login), dash(a.SKU), a.Source, dash(strings.Join(a.Groups, ",")), status, maskSecret(a.Token))
+	}
+	return tw.Flush()
+}
+
+// cmdToken checks a token given on the command line, or every account.
+func cmdToken(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: gopilot token check [ghu_token]")
+	}
+
+	var tokens []string
+	if len(args) > 1 {
+		tokens = args[1:]
+	} else {
+		for _, a := range store.accounts() {
+			tokens = append(tokens, a.Token)
+		}
+	}
+	if len(tokens) == 0 {
+		return errNoAccount
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tLOGIN\tSKU\tCOPILOT TOKEN EXPIRES")
+	for _, token := range tokens {
+		login, err := githubLogin(token)
+		if err != nil {
+			login = "invalid: " + err.Error()
+		}
+		expires := "-"
+		clearAccToken(token)
+		if _, err := getAccToken(token); err != nil {
+			expires = err.Error()
+		} else if cached, found := cachedAccToken(token); found {
+			expires = cached.ExpiresAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", maskSecret(token), login, checkGhuToken(token), expires)
+	}
+	return tw.Flush()
+}
+
+func cmdModels(args []string) error {
+	fs := flag.NewFlagSet("models", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the catalog as JSON")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q\n\n%s", fs.Args(), usage)
+	}
+
+	if err := catalog.refresh(); err != nil {
+		return err
+	}
+	models := catalog.list()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(models)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tVENDOR\tTYPE\tCONTEXT\tOUTPUT\tTOOLS\tVISION")
+	for _, m := range models {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%v\t%v\n", m.ID, m.Name, m.Vendor, m.Type, m.MaxContextTokens, m.MaxOutputTokens, m.ToolCalls, m.Vision)
+	}
+	return tw.Flush()
+}
+
+// cmdChat starts an interactive chat on a terminal. Given a prompt, or
+// input on a pipe, it answers once and exits; piped input is appended to
+// the prompt.
+func cmdChat(args []string) error {
+	fs := flag.NewFlagSet("chat", flag.ExitOnError)
+	model := fs.String("model", defaultChatModel, "model to use")
+	system := fs.String("system", "", "system prompt")
+	fs.Parse(args)
+	// Chat goes upstream directly, but through the same guardrails.
+	if err := loadGuardrails(guardrailsPath); err != nil {
+		return err
+	}
+
+	session := &chatSession{Model: *model, System: *system}
+	prompt := strings.Join(fs.Args(), " ")
+	if prompt == "" && stdinIsTerminal() {
+		return runChatREPL(os.Stdin, os.Stdout, session)
+	}
+
+	if !stdinIsTerminal() {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if piped := strings.TrimSpace(string(b)); piped != "" {
+			prompt = strings.TrimSpace(prompt + "\n\n" + piped)
+		}
+	}
+	if prompt == "" {
+		return errors.New("usage: gopilot chat [-model m] [-system s] [prompt]")
+	}
+	prompt, err := expandAttachments(prompt)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if _, err := streamChat(ctx, session.Model, session.request(prompt), os.Stdout); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+func cmdKeys(args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	arg := func() (string, error) {
+		if len(args) != 2 {
+			return "", fmt.Errorf("usage: gopilot keys %s <id>", args[0])
+		}
+		return args[1], nil
+	}
+
+	switch args[0] {
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tKEY\tGROUP\tSTATUS\tCREATED")
+		for _, k := range store.keys() {
+			v := viewKey(k)
+			status := "enabled"
+			if v.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", v.ID, dash(v.Name), v.Key, dash(v.Group), status, v.CreatedAt.Local().Format(time.DateTime))
+		}
+		return tw.Flush()
+	case "add":
+		k, err := store.addKey(strings.Join(args[1:], " "))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created key %s: %s\n", k.ID, k.Key)
+	case "enable", "disable":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		if err := store.setKeyDisabled(id, args[0] == "disable"); err != nil {
+			return fmt.Errorf("key %s: %w", id, err)
+		}
+	case "truncate":
+		if len(args) != 3 || !validTruncateMode(args[2]) {
+			return errors.New("usage: gopilot keys truncate <id> off|middle-out|summarize")
+		}
+		err := store.updateKey(args[1], func(k *ClientKey) {
+			k.Truncate = args[2]
+		})
+		if err != nil {
+			return fmt.Errorf("key %s: %w", args[1], err)
+		}
+	case "cache":
+		if len(args) != 3 || args[2] != cacheOn && args[2] != cacheOff && args[2] != "auto" {
+			return errors.New("usage: gopilot keys cache <id> on|off|auto")
+		}
+		mode := args[2]
+		if mode == "auto" {
+			mode = cacheAuto
+		}
+		err := store.updateKey(args[1], func(k *ClientKey) {
+			k.Cache = mode
+		})
+		if err != nil {
+			return fmt.Errorf("key %s: %w", args[1], err)
+		}
+	case "remove":
+		id, err := arg()
+		if err != nil {
+			return err
+		}
+		if err := store.removeKey(id); err != nil {
+			return fmt.Errorf("key %s: %w", id, err)
+		}
+	default:
+		return errors.New("usage: gopilot keys list|add [name]|enable <id>|disable <id>|truncate <id> <mode>|cache <id> <mode>|remove <id>")
+	}
+	fmt.Println("A running server sharing STORE_PATH picks up the change within a few seconds.")
+	return nil
+}
+
+func dash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+package gopilot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Coalescing shares one upstream call among identical requests in flight.
+// COALESCE turns it on for non-stream requests, COALESCE_STREAMS fans
+// streams out as well.
+var coalesceRequests = os.Getenv("COALESCE") != ""
+var coalesceStreams = os.Getenv("COALESCE_STREAMS") != ""
+
+// coalesceKey is the response cache hash of a request plus what decides the
+// shape of its answer and whose credentials serve it, or "" if it isn't
+// coalesced. The client's path is part of it, as hooks and validation
+// differ between paths. Requests that opted out of the cache aren't
+// coalesced either.
+func coalesceKey(r *http.Request, cred *credential, rt *route, url string, body map[string]interface{}) string {
+	isStream, _ := body["stream"].(bool)
+	if !coalesceRequests || isStream && !coalesceStreams || cacheMode(r, cred) == cacheOff {
+		return ""
+	}
+	key := r.URL.Path + " " + credentialScope(cred, rt.group()) + " " + requestHash(url, rt.models[0], body)
+	if isStream {
+		opts, _ := json.Marshal(body["stream_options"])
+		key += " stream " + string(opts)
+	}
+	return key
+}
+
+// credentialScope names whose upstream credentials serve a request: the
+// pool accounts of a group, or the caller's own GitHub token.
+func credentialScope(cred *credential, group string) string {
+	if cred.account != nil {
+		return "pool:" + group
+	}
+	sum := sha256.Sum256([]byte(cred.token))
+	return "token:" + hex.EncodeToString(sum[:])
+}
+
+// flight is one upstream call and its answer as written so far. The call
+// writes into it as an http.ResponseWriter, and every request sharing it
+// copies the answer out at its own pace.
+type flight struct {
+	mu     sync.Mutex
+	header http.Header
+	sent   http.Header
+	status int
+	body   []byte
+	done   bool
+	// wake is closed and replaced whenever the answer grows.
+	wake chan struct{}
+
+	subscribers int
+	cancel      context.CancelFunc
+}
+
+var flights = struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}{m: map[string]*flight{}}
+
+// coalesce answers r from the flight for key, starting one with send if
+// none is in the air. The upstream call doesn't belong to any one client:
+// it is cancelled only when every request sharing it has gone.
+func coalesce(w http.ResponseWriter, r *http.Request, key string, send func(ctx context.Context, w http.ResponseWriter)) {
+	flights.mu.Lock()
+	f, ok := flights.m[key]
+	if ok {
+		w.Header().Set("X-Gopilot-Coalesced", "1")
+	} else {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		f = &flight{header: http.Header{}, wake: make(chan struct{}), cancel: cancel}
+		flights.m[key] = f
+		go f.run(ctx, key, send)
+	}
+	f.subscribers++
+	flights.mu.Unlock()
+
+	f.follow(r.Context(), w)
+
+	flights.mu.Lock()
+	defer flights.mu.Unlock()
+	f.subscribers--
+	if f.subscribers == 0 {
+		f.cancel()
+		if flights.m[key] == f {
+			delete(flights.m, key)
+		}
+	}
+}
+
+func (f *flight) run(ctx context.Context, key string, send func(ctx context.Context, w http.ResponseWriter)) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Error in coalesced request:", err)
+			f.WriteHeader(http.StatusBadGateway)
+		}
+		f.finish()
+		f.cancel()
+		flights.mu.Lock()
+		if flights.m[key] == f {
+			delete(flights.m, key)
+		}
+		flights.mu.Unlock()
+	}()
+	send(ctx, f)
+}
+
+// Header, WriteHeader, Write and Flush are what the upstream call writes
+// its answer through. Only the call's goroutine uses the header map.
+func (f *flight) Header() http.Header {
+	return f.header
+}
+
+func (f *flight) WriteHeader(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeHeader(status)
+}
+
+func (f *flight) writeHeader(status int) {
+	if f.status != 0 {
+		return
+	}
+	f.status = status
+	f.sent = f.header.Clone()
+	f.broadcast()
+}
+
+func (f *flight) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeHeader(http.StatusOK)
+	f.body = append(f.body, b...)
+	f.broadcast()
+	return len(b), nil
+}
+
+func (f *flight) Flush() {}
+
+func (f *flight) finish() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeHeader(http.StatusOK)
+	f.done = true
+	f.broadcast()
+}
+
+func (f *flight) broadcast() {
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// follow copies the answer to w as it arrives, until it is complete or the
+// client goes away.
+func (f *flight) follow(ctx context.Context, w http.ResponseWriter) {
+	written := 0
+	headerSent := false
+	for {
+		f.mu.Lock()
+		status, header, done, wake := f.status, f.sent, f.done, f.wake
+		// The answer is only appended to, so this part stays as it is.
+		body := f.body[written:]
+		f.mu.Unlock()
+
+		if status != 0 && !headerSent {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			headerSent = true
+		}
+		if len(body) > 0 {
+			if _, err := w.Write(body); err != nil {
+				return
+			}
+			if fl, ok := w.(http.Flusher); ok {
+				fl.Flush()
+			}
+			written += len(body)
+		}
+		if done {
+			return
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package gopilot
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	old := coalesceRequests
+	coalesceRequests = true
+	t.Cleanup(func() { coalesceRequests = old })
+
+	pool := &credential{account: &Account{ID: "a"}, token: "ghu_pool"}
+	otherPool := &credential{account: &Account{ID: "b"}, token: "ghu_other"}
+	own := &credential{token: "ghu_alice"}
+	optedOut := &credential{key: &ClientKey{ID: "k", Cache: cacheOff}, account: pool.account, token: pool.token}
+	body := map[string]interface{}{"model": "gpt-4o", "messages": []interface{}{msg("user", "hi")}}
+	rt := &route{models: []string{"gpt-4o"}}
+	grouped := &route{rule: &routeRule{Group: "team"}, models: []string{"gpt-4o"}}
+	key := func(cred *credential, rt *route, header string) string {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		if header != "" {
+			r.Header.Set("X-Gopilot-Cache", header)
+		}
+		return coalesceKey(r, cred, rt, completionsUrl, body)
+	}
+	want := key(pool, rt, "")
+
+	tests := []struct {
+		name string
+		got  string
+		same bool
+	}{
+		{"another pool account", key(otherPool, rt, ""), true},
+		{"own token", key(own, rt, ""), false},
+		{"another own token", key(&credential{token: "ghu_bob"}, rt, ""), false},
+		{"account group", key(pool, grouped, ""), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if (tt.got == want) != tt.same {
+				t.Errorf("key equal = %v, want %v", tt.got == want, tt.same)
+			}
+		})
+	}
+	if key(own, rt, "") != key(&credential{token: "ghu_alice"}, rt, "") {
+		t.Error("the same token got different keys")
+	}
+	if k := key(optedOut, rt, ""); k != "" {
+		t.Errorf("key that opted out of caching got %q", k)
+	}
+	if k := key(pool, rt, cacheOff); k != "" {
+		t.Errorf("request that opted out of caching got %q", k)
+	}
+}
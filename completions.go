@@ -0,0 +1,377 @@
+package gopilot
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// completionsModel serves /v1/completions requests for models Copilot
+// doesn't offer, such as davinci or babbage.
+var completionsModel = GetEnvOrDefault("COMPLETIONS_MODEL", "gpt-4o-mini")
+
+const completionSystemPrompt = "You are a text completion engine. Continue the user's text exactly where it stops. " +
+	"Output only the continuation: do not repeat the text, add commentary or wrap it in code fences."
+
+const infillSystemPrompt = "You fill in the middle of a document. The user sends the text before the gap in <prefix> " +
+	"and the text after it in <suffix>. Output only the text that belongs in the gap, so that prefix + output + suffix " +
+	"reads as one document. Do not repeat the prefix or suffix, add commentary or wrap it in code fences."
+
+// completionRequest is a legacy /v1/completions request.
+type completionRequest struct {
+	Model            string          `json:"model"`
+	Prompt           json.RawMessage `json:"prompt"`
+	Suffix           string          `json:"suffix"`
+	MaxTokens        *int            `json:"max_tokens"`
+	Temperature      *float64        `json:"temperature"`
+	TopP             *float64        `json:"top_p"`
+	N                int             `json:"n"`
+	Stop             json.RawMessage `json:"stop"`
+	Stream           bool            `json:"stream"`
+	Echo             bool            `json:"echo"`
+	PresencePenalty  *float64        `json:"presence_penalty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty"`
+	User             string          `json:"user"`
+}
+
+// prompts returns the request's prompt as a list. Token-array prompts can't
+// be turned into chat messages and are rejected.
+func (c *completionRequest) prompts() ([]string, error) {
+	if len(c.Prompt) == 0 || string(c.Prompt) == "null" {
+		return []string{""}, nil
+	}
+	var single string
+	if err := json.Unmarshal(c.Prompt, &single); err == nil {
+		return []string{single}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(c.Prompt, &list); err == nil && len(list) > 0 {
+		return list, nil
+	}
+	return nil, errors.New("prompt must be a string or an array of strings; token prompts are not supported")
+}
+
+// guard runs the request guardrails over the prompts and suffix, returning
+// the guardrails that redacted something.
+func (c *completionRequest) guard(prompts []string) ([]string, *requestError) {
+	fields := map[string]interface{}{"suffix": c.Suffix}
+	if len(prompts) == 1 {
+		fields["prompt"] = prompts[0]
+	} else {
+		list := make([]interface{}, len(prompts))
+		for i, p := range prompts {
+			list[i] = p
+		}
+		fields["prompt"] = list
+	}
+	redacted, e := applyGuardrails(fields)
+	if e != nil {
+		return nil, e
+	}
+	switch p := fields["prompt"].(type) {
+	case string:
+		prompts[0] = p
+	case []interface{}:
+		for i := range p {
+			prompts[i] = p[i].(string)
+		}
+	}
+	c.Suffix = fields["suffix"].(string)
+	return redacted, nil
+}
+
+// chatBody wraps one prompt into a chat completion request.
+func (c *completionRequest) chatBody(prompt string) map[string]interface{} {
+	messages := []chatMessage{
+		{Role: "system", Content: completionSystemPrompt},
+		{Role: "user", Content: prompt},
+	}
+	if c.Suffix != "" {
+		messages = []chatMessage{
+			{Role: "system", Content: infillSystemPrompt},
+			{Role: "user", Content: "<prefix>" + prompt + "</prefix><suffix>" + c.Suffix + "</suffix>"},
+		}
+	}
+
+	body := map[string]interface{}{
+		"messages": messages,
+		"stream":   c.Stream,
+	}
+	if c.MaxTokens != nil {
+		body["max_tokens"] = *c.MaxTokens
+	}
+	if c.Temperature != nil {
+		body["temperature"] = *c.Temperature
+	}
+	if c.TopP != nil {
+		body["top_p"] = *c.TopP
+	}
+	if c.N > 1 {
+		body["n"] = c.N
+	}
+	if len(c.Stop) > 0 && string(c.Stop) != "null" {
+		body["stop"] = c.Stop
+	}
+	if c.PresencePenalty != nil {
+		body["presence_penalty"] = *c.PresencePenalty
+	}
+	if c.FrequencyPenalty != nil {
+		body["frequency_penalty"] = *c.FrequencyPenalty
+	}
+	return body
+}
+
+type completionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type completionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type completionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *completionUsage   `json:"usage,omitempty"`
+}
+
+// completionRoute picks the Copilot models for a legacy request. Unless a
+// route names the model, the requested one is used unless the catalog says
+// Copilot doesn't serve it as a chat model; then COMPLETIONS_MODEL is. While
+// the catalog isn't loaded the requested model is tried as is.
+func completionRoute(model string) *route {
+	rt := routes.resolve(model)
+	if rt.rule != nil && rt.rule.Model != "" {
+		return rt
+	}
+	if model == "" {
+		rt.models[0] = completionsModel
+		return rt
+	}
+	if len(catalog.list()) == 0 {
+		return rt
+	}
+	if m, ok := catalog.lookup(model); !ok || m.Type != "chat" {
+		rt.models[0] = completionsModel
+	}
+	return rt
+}
+
+// writeStreamError ends an event stream that has already started with an
+// error event, as OpenAI reports errors mid-stream.
+func writeStreamError(w http.ResponseWriter, status int, message string) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    "upstream_error",
+			"code":    status,
+		},
+	})
+	writeEvent(w, b)
+}
+
+// handleCompletions emulates /v1/completions on top of chat completions.
+// Each prompt becomes its own chat request; choice indexes run across
+// prompts as OpenAI numbers them, prompt i owning i*n to i*n+n-1.
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	rec := &requestRecord{Time: time.Now(), Path: r.URL.Path}
+	sw := newStatusRecorder(w)
+	w = sw
+	defer func() { requestLog.record(rec, sw) }()
+
+	var req completionRequest
+	if !hooks.requestInto(w, r, &req) {
+		return
+	}
+	rec.Model = req.Model
+	prompts, err := req.prompts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.N < 1 {
+		req.N = 1
+	}
+	redacted, e := req.guard(prompts)
+	if e != nil {
+		writeRequestError(w, e)
+		return
+	}
+	if len(redacted) > 0 {
+		w.Header().Set("X-Gopilot-Redacted", strings.Join(redacted, ","))
+	}
+
+	rt := completionRoute(req.Model)
+	cred, ok := authorizeUpstream(w, r, rec, rt.group())
+	if !ok {
+		return
+	}
+	failed := true
+	if cred.account != nil {
+		done := cred.account.begin()
+		defer func() { done(failed) }()
+	}
+
+	out := &completionResponse{
+		ID:      "cmpl-" + randomID(12),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []completionChoice{},
+		Usage:   &completionUsage{},
+	}
+	if req.Stream {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	}
+	script := hooks.call(r.URL.Path)
+	model := rt.models[0]
+
+	// Once a prompt has streamed, errors can only go out as events.
+	streaming := false
+	fail := func(status int, message string) {
+		if streaming {
+			writeStreamError(w, status, message)
+			return
+		}
+		http.Error(w, message, status)
+	}
+	for i, prompt := range prompts {
+		resp, m, err := sendRouted(r.Context(), cred, completionsUrl, rt, req.chatBody(prompt))
+		model = m
+		if err != nil {
+			fail(sendErrorStatus(err), err.Error())
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			log.Printf("补全失败：%s %d, %s ", model, resp.StatusCode, b)
+			fail(resp.StatusCode, string(b))
+			return
+		}
+
+		if req.Stream {
+			streaming = true
+			err = streamCompletion(w, resp.Body, out, &req, prompt, i*req.N, script, model)
+		} else {
+			err = collectCompletion(resp.Body, out, &req, prompt, i*req.N)
+		}
+		resp.Body.Close()
+		if err != nil {
+			if req.Stream {
+				log.Println("Error relaying completion stream:", err)
+			}
+			fail(http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	failed = false
+
+	if req.Stream {
+		io.WriteString(w, "data: [DONE]\n\n")
+		return
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if script != nil {
+		data = script.response(model, data)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
+
+// collectCompletion turns a chat completion into legacy choices on out.
+func collectCompletion(body io.Reader, out *completionResponse, req *completionRequest, prompt string, offset int) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	guard := newResponseGuard()
+	for _, choice := range gjson.GetBytes(data, "choices").Array() {
+		finish := choice.Get("finish_reason").String()
+		text, reason := guard.complete(choice.Get("message.content").String(), &finish)
+		if req.Echo {
+			text = prompt + text
+		}
+		out.Choices = append(out.Choices, completionChoice{
+			Text:         text,
+			Index:        offset + int(choice.Get("index").Int()),
+			FinishReason: reason,
+		})
+	}
+	out.Usage.PromptTokens += int(gjson.GetBytes(data, "usage.prompt_tokens").Int())
+	out.Usage.CompletionTokens += int(gjson.GetBytes(data, "usage.completion_tokens").Int())
+	out.Usage.TotalTokens += int(gjson.GetBytes(data, "usage.total_tokens").Int())
+	return nil
+}
+
+// streamCompletion relays a chat completion stream as legacy text_completion
+// chunks, through the response hooks of script. With echo the prompt goes
+// out first as its own chunk per choice.
+func streamCompletion(w http.ResponseWriter, body io.Reader, out *completionResponse, req *completionRequest, prompt string, offset int, script *hookCall, model string) error {
+	send := func(choice completionChoice) error {
+		chunk := *out
+		chunk.Usage = nil
+		chunk.Choices = []completionChoice{choice}
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		return script.emit(w, model, b)
+	}
+
+	if req.Echo {
+		for n := 0; n < req.N; n++ {
+			if err := send(completionChoice{Text: prompt, Index: offset + n}); err != nil {
+				return err
+			}
+		}
+	}
+
+	guard := newResponseGuard()
+	err := scanSSE(body, func(data []byte) error {
+		for _, choice := range gjson.GetBytes(data, "choices").Array() {
+			index := int(choice.Get("index").Int())
+			var finish *string
+			if f := choice.Get("finish_reason"); f.Exists() && f.Type != gjson.Null {
+				s := f.String()
+				finish = &s
+			}
+			text, finish := guard.text(index, choice.Get("delta.content").String(), finish)
+			if text == "" && finish == nil {
+				continue
+			}
+			if err := send(completionChoice{Text: text, Index: offset + index, FinishReason: finish}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, held := range guard.tail() {
+		if err := send(completionChoice{Text: *held.Delta.Content, Index: offset + held.Index}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
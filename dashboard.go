@@ -0,0 +1,200 @@
+package gopilot
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+var adminPassword = GetEnvOrDefault("ADMIN_PASSWORD", "")
+
+const dashboardCookie = "gopilot_dashboard"
+
+// dashboardSessions maps session cookies to nothing; presence is the login.
+var dashboardSessions = cache.New(12*time.Hour, time.Hour)
+
+// usageBar is one bar of the inline SVG usage charts.
+type usageBar struct {
+	X, Y, Height int
+	ErrorHeight  int
+	Label        string
+}
+
+type usageChart struct {
+	Requests int
+	Errors   int
+	Bars     []usageBar
+}
+
+// chartHeight is the drawable height of a usage chart in pixels.
+const chartHeight = 40
+
+func newUsageChart(buckets [24]usageBucket) usageChart {
+	var chart usageChart
+	max := 1
+	for _, b := range buckets {
+		chart.Requests += b.Requests
+		chart.Errors += b.Errors
+		if b.Requests > max {
+			max = b.Requests
+		}
+	}
+	for i, b := range buckets {
+		h := b.Requests * chartHeight / max
+		chart.Bars = append(chart.Bars, usageBar{
+			X:           i * 10,
+			Y:           chartHeight - h,
+			Height:      h,
+			ErrorHeight: b.Errors * chartHeight / max,
+			Label:       fmt.Sprintf("%dh ago: %d requests, %d errors", 23-i, b.Requests, b.Errors),
+		})
+	}
+	return chart
+}
+
+type keyUsage struct {
+	keyView
+	Usage usageChart
+}
+
+// dashboardHandler serves the server-rendered admin dashboard. It is enabled
+// by ADMIN_PASSWORD or ADMIN_TOKEN, either of which can be used to log in.
+func dashboardHandler(t *template.Template) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminPassword == "" && adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/dashboard"), "/")
+		if action == "login" && r.Method == http.MethodPost {
+			dashboardLogin(w, r, t)
+			return
+		}
+		if !dashboardAuthenticated(r) {
+			renderTemplate(w, t, "login.tmpl", map[string]interface{}{"title": "gopilot"})
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if err := dashboardAction(w, r, t, action); err != nil {
+				log.Println("dashboard:", err)
+				renderDashboard(w, t, map[string]interface{}{"error": err.Error()})
+			}
+			return
+		}
+		renderDashboard(w, t, map[string]interface{}{})
+	})
+}
+
+func dashboardAuthenticated(r *http.Request) bool {
+	c, err := r.Cookie(dashboardCookie)
+	if err != nil {
+		return false
+	}
+	_, found := dashboardSessions.Get(c.Value)
+	return found
+}
+
+func dashboardLogin(w http.ResponseWriter, r *http.Request, t *template.Template) {
+	password := []byte(r.FormValue("password"))
+	ok := (adminPassword != "" && subtle.ConstantTimeCompare(password, []byte(adminPassword)) == 1) ||
+		(adminToken != "" && subtle.ConstantTimeCompare(password, []byte(adminToken)) == 1)
+	if !ok {
+		renderTemplate(w, t, "login.tmpl", map[string]interface{}{
+			"title": "gopilot",
+			"error": "密码错误",
+		})
+		return
+	}
+
+	session := randomID(16)
+	dashboardSessions.SetDefault(session, true)
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    session,
+		Path:     "/dashboard",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int((12 * time.Hour).Seconds()),
+	})
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// dashboardAction handles the dashboard's form posts, which mirror the
+// /admin API.
+func dashboardAction(w http.ResponseWriter, r *http.Request, t *template.Template, action string) error {
+	parts := strings.Split(action, "/")
+	var err error
+	switch {
+	case action == "logout":
+		if c, err := r.Cookie(dashboardCookie); err == nil {
+			dashboardSessions.Delete(c.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: "/dashboard", MaxAge: -1})
+	case action == "catalog/refresh":
+		err = catalog.refresh()
+	case action == "keys":
+		var k *ClientKey
+		if k, err = store.addKey(r.FormValue("name")); err == nil {
+			// Render directly so the new key is shown exactly once
+			renderDashboard(w, t, map[string]interface{}{"newKey": k.Key})
+			return nil
+		}
+	case len(parts) == 3 && parts[0] == "keys" && (parts[2] == "enable" || parts[2] == "disable"):
+		err = store.setKeyDisabled(parts[1], parts[2] == "disable")
+	case len(parts) == 3 && parts[0] == "keys" && parts[2] == "delete":
+		err = store.removeKey(parts[1])
+	case len(parts) == 3 && parts[0] == "accounts" && (parts[2] == "enable" || parts[2] == "disable"):
+		err = store.setAccountDisabled(parts[1], parts[2] == "disable")
+	default:
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	return nil
+}
+
+func renderDashboard(w http.ResponseWriter, t *template.Template, data map[string]interface{}) {
+	accounts := []accountView{}
+	for _, a := range store.accounts() {
+		accounts = append(accounts, viewAccount(a))
+	}
+	keys := []keyUsage{}
+	for _, k := range store.keys() {
+		keys = append(keys, keyUsage{viewKey(k), newUsageChart(requestLog.hourlyUsage(k.ID, false))})
+	}
+	fetchedAt, catalogErr := catalog.state()
+
+	data["title"] = "gopilot"
+	data["uptime"] = time.Since(startedAt).Round(time.Second).String()
+	data["accounts"] = accounts
+	data["keys"] = keys
+	data["total"] = newUsageChart(requestLog.hourlyUsage("", true))
+	data["anonymous"] = newUsageChart(requestLog.hourlyUsage("", false))
+	data["recent"] = requestLog.recentRequests(50, false)
+	data["errors"] = requestLog.recentRequests(20, true)
+	data["models"] = catalog.list()
+	data["catalogFetchedAt"] = fetchedAt
+	if catalogErr != nil {
+		data["catalogError"] = catalogErr.Error()
+	}
+	renderTemplate(w, t, "dashboard.tmpl", data)
+}
+
+func renderTemplate(w http.ResponseWriter, t *template.Template, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := t.ExecuteTemplate(w, name, data); err != nil {
+		log.Println("template:", err)
+	}
+}
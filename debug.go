@@ -4,15 +4,177 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tidwall/gjson"
 )
 
+// debugConfig controls what the debug middleware captures and how long the
+// captures are kept. Everything is read from the environment once, when the
+// middleware is built.
+type debugConfig struct {
+	dir          string
+	maxAge       time.Duration
+	maxSize      int64
+	maxBody      int64
+	sampleRate   float64
+	routes       []string
+	models       []string
+	statuses     []string
+	metadataOnly bool
+}
+
+// metadataPeekSize is how much of the request body is kept in metadata-only
+// mode, enough to pick out "model" and "stream" for the common payloads.
+const metadataPeekSize = 4 << 10
+
+func loadDebugConfig() (*debugConfig, error) {
+	c := &debugConfig{
+		dir:          GetEnvOrDefault("DEBUG_DIR", "debug_logs"),
+		routes:       splitList(os.Getenv("DEBUG_ROUTES")),
+		models:       splitList(os.Getenv("DEBUG_MODELS")),
+		statuses:     splitList(os.Getenv("DEBUG_STATUS")),
+		metadataOnly: os.Getenv("DEBUG_METADATA_ONLY") != "",
+	}
+
+	var err error
+	if c.maxAge, err = time.ParseDuration(GetEnvOrDefault("DEBUG_MAX_AGE", "168h")); err != nil {
+		return nil, fmt.Errorf("DEBUG_MAX_AGE: %w", err)
+	}
+	if c.maxSize, err = parseSize(GetEnvOrDefault("DEBUG_MAX_SIZE", "500MB")); err != nil {
+		return nil, fmt.Errorf("DEBUG_MAX_SIZE: %w", err)
+	}
+	if c.maxBody, err = parseSize(GetEnvOrDefault("DEBUG_MAX_BODY", "1MB")); err != nil {
+		return nil, fmt.Errorf("DEBUG_MAX_BODY: %w", err)
+	}
+	if c.sampleRate, err = strconv.ParseFloat(GetEnvOrDefault("DEBUG_SAMPLE_RATE", "1"), 64); err != nil {
+		return nil, fmt.Errorf("DEBUG_SAMPLE_RATE: %w", err)
+	}
+	for _, s := range c.statuses {
+		if !validStatusFilter(s) {
+			return nil, fmt.Errorf("DEBUG_STATUS: invalid filter %q", s)
+		}
+	}
+	if c.metadataOnly {
+		c.maxBody = metadataPeekSize
+	}
+	return c, nil
+}
+
+// matchRoute reports whether the request path is one we want to capture.
+// DEBUG_ROUTES is a list of path prefixes; empty means every route.
+func (c *debugConfig) matchRoute(p string) bool {
+	if len(c.routes) == 0 {
+		return true
+	}
+	for _, prefix := range c.routes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchModel matches against DEBUG_MODELS, a list of glob patterns such as
+// "gpt-4*".
+func (c *debugConfig) matchModel(model string) bool {
+	if len(c.models) == 0 {
+		return true
+	}
+	for _, pattern := range c.models {
+		if matchModel(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchStatus matches against DEBUG_STATUS, see statusMatches.
+func (c *debugConfig) matchStatus(status int) bool {
+	if len(c.statuses) == 0 {
+		return true
+	}
+	return statusMatches(c.statuses, status)
+}
+
+// statusMatches reports whether status matches one of filters. Each entry is
+// either an exact code ("429"), a class ("5xx") or "error" for anything
+// >= 400.
+func statusMatches(filters []string, status int) bool {
+	code := strconv.Itoa(status)
+	for _, s := range filters {
+		switch {
+		case s == "error":
+			if status >= 400 {
+				return true
+			}
+		case len(s) == 3 && strings.HasSuffix(s, "xx"):
+			if code[0] == s[0] {
+				return true
+			}
+		case s == code:
+			return true
+		}
+	}
+	return false
+}
+
+func validStatusFilter(s string) bool {
+	if s == "error" {
+		return true
+	}
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		return s[0] >= '1' && s[0] <= '5'
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseSize parses sizes like "512", "64KB", "500MB" or "2GB".
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
+
 func newTempfile(baseDir string) (*os.File, error) {
 	// Create base directory if it doesn't exist
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
@@ -32,65 +194,234 @@ func newTempfile(baseDir string) (*os.File, error) {
 	return file, nil
 }
 
+// capBuffer keeps the first limit bytes written to it and counts the rest,
+// so large bodies can pass through without being held in memory.
+type capBuffer struct {
+	buf   bytes.Buffer
+	limit int64
+	total int64
+}
+
+func (c *capBuffer) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	if room := c.limit - int64(c.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			c.buf.Write(p[:room])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *capBuffer) truncated() bool {
+	return c.total > int64(c.buf.Len())
+}
+
 type debugResponseWriter struct {
 	http.ResponseWriter
-	logFile  *os.File
-	isStream bool
+	status int
+	body   *capBuffer
+	// model is the one the handler resolved, from the whole body.
+	model string
+}
+
+func (dw *debugResponseWriter) setModel(model string) {
+	dw.model = model
+}
+
+func (dw *debugResponseWriter) WriteHeader(status int) {
+	if dw.status == 0 {
+		dw.status = status
+	}
+	dw.ResponseWriter.WriteHeader(status)
 }
 
 func (dw *debugResponseWriter) Write(b []byte) (int, error) {
-	n, err := dw.ResponseWriter.Write(b)
-	if dw.logFile != nil {
-		if _, werr := dw.logFile.Write(b); werr != nil {
-			log.Println("Error writing to debug log:", werr)
-		}
+	if dw.status == 0 {
+		dw.status = http.StatusOK
 	}
+	n, err := dw.ResponseWriter.Write(b)
+	dw.body.Write(b[:n])
 	return n, err
 }
 
+func (dw *debugResponseWriter) Flush() {
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func DebugLoggingMiddleware(next http.Handler) http.Handler {
+	if os.Getenv("DEBUG") == "" {
+		return next
+	}
+
+	cfg, err := loadDebugConfig()
+	if err != nil {
+		log.Println("Debug logging disabled:", err)
+		return next
+	}
+	janitor := &debugJanitor{cfg: cfg}
+	go janitor.prune()
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if os.Getenv("DEBUG") == "" {
+		if !cfg.matchRoute(r.URL.Path) || (cfg.sampleRate < 1 && rand.Float64() >= cfg.sampleRate) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Capture request body
-		body, _ := io.ReadAll(r.Body)
-		r.Body.Close()
-		r.Body = io.NopCloser(bytes.NewBuffer(body))
+		// Tee the request body so the handler still streams it in full
+		reqBody := &capBuffer{limit: cfg.maxBody}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
 
-		// Determine if stream
-		isStream := gjson.GetBytes(body, "stream").Bool()
-		model := gjson.GetBytes(body, "model").String()
+		dw := &debugResponseWriter{
+			ResponseWriter: w,
+			body:           &capBuffer{limit: cfg.maxBody},
+		}
 
-		logPath := filepath.Join("debug_logs", r.URL.Path, model)
-		// Create log file
-		logFile, err := newTempfile(logPath)
+		start := time.Now()
+		next.ServeHTTP(dw, r)
+		duration := time.Since(start)
+
+		if dw.status == 0 {
+			dw.status = http.StatusOK
+		}
+		// The captured body may be cut short, so prefer the handler's model.
+		model := dw.model
+		if model == "" {
+			model = gjson.GetBytes(reqBody.buf.Bytes(), "model").String()
+		}
+		if !cfg.matchModel(model) || !cfg.matchStatus(dw.status) {
+			return
+		}
+
+		logFile, err := newTempfile(filepath.Join(cfg.dir, path.Clean("/"+r.URL.Path), safePathElem(model)))
 		if err != nil {
 			log.Println("Debug logging error:", err)
-			next.ServeHTTP(w, r)
 			return
 		}
 		defer logFile.Close()
 
+		isStream := gjson.GetBytes(reqBody.buf.Bytes(), "stream").Bool()
+		fmt.Fprintf(logFile, "# %s %s %s\n", start.Format(time.RFC3339), r.Method, r.URL.Path)
+		fmt.Fprintf(logFile, "# model: %s stream: %v status: %d duration: %s\n", model, isStream, dw.status, duration)
+		fmt.Fprintf(logFile, "# request: %d bytes%s, response: %d bytes%s\n\n",
+			reqBody.total, truncatedNote(reqBody), dw.body.total, truncatedNote(dw.body))
+		if !cfg.metadataOnly {
+			logFile.Write(reqBody.buf.Bytes())
+			logFile.WriteString("\n\n")
+			logFile.Write(dw.body.buf.Bytes())
+		}
+
 		absoluteLogPath, err := filepath.Abs(logFile.Name())
 		if err != nil {
 			absoluteLogPath = logFile.Name()
 		}
-
-		// Write initial log information
 		log.Printf("Debug log: %s (stream: %v)", absoluteLogPath, isStream)
-		logFile.Write(body)
-		logFile.WriteString("\n\n")
 
-		// Wrap response writer
-		dw := &debugResponseWriter{
-			ResponseWriter: w,
-			logFile:        logFile,
-			isStream:       isStream,
+		janitor.maybePrune()
+	})
+}
+
+// safePathElem makes a client-supplied name usable as one directory name.
+func safePathElem(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < ' ' {
+			return '_'
 		}
+		return r
+	}, s)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
 
-		next.ServeHTTP(dw, r)
+func truncatedNote(c *capBuffer) string {
+	if c.truncated() {
+		return " (truncated)"
+	}
+	return ""
+}
+
+// debugJanitor enforces DEBUG_MAX_AGE and DEBUG_MAX_SIZE on the capture
+// directory. Pruning runs in the background at most once a minute.
+type debugJanitor struct {
+	cfg     *debugConfig
+	mu      sync.Mutex
+	last    time.Time
+	running bool
+}
+
+func (j *debugJanitor) maybePrune() {
+	j.mu.Lock()
+	if j.running || time.Since(j.last) < time.Minute {
+		j.mu.Unlock()
+		return
+	}
+	j.running = true
+	j.mu.Unlock()
+
+	go j.prune()
+}
+
+func (j *debugJanitor) prune() {
+	defer func() {
+		j.mu.Lock()
+		j.running = false
+		j.last = time.Now()
+		j.mu.Unlock()
+	}()
+
+	type capture struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var captures []capture
+	var total int64
+
+	err := filepath.WalkDir(j.cfg.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".log") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if j.cfg.maxAge > 0 && time.Since(info.ModTime()) > j.cfg.maxAge {
+			if err := os.Remove(p); err != nil {
+				log.Println("Debug log prune error:", err)
+			}
+			return nil
+		}
+		captures = append(captures, capture{p, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Println("Debug log prune error:", err)
+		return
+	}
+
+	if j.cfg.maxSize <= 0 || total <= j.cfg.maxSize {
+		return
+	}
+	sort.Slice(captures, func(a, b int) bool {
+		return captures[a].modTime.Before(captures[b].modTime)
 	})
+	for _, c := range captures {
+		if total <= j.cfg.maxSize {
+			break
+		}
+		if err := os.Remove(c.path); err != nil {
+			log.Println("Debug log prune error:", err)
+			continue
+		}
+		total -= c.size
+	}
 }
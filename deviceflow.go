@@ -0,0 +1,149 @@
+package gopilot
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Device flow statuses reported to the /auth page.
+const (
+	deviceStatusPending   = "pending"
+	deviceStatusSlowDown  = "slow_down"
+	deviceStatusExpired   = "expired"
+	deviceStatusDenied    = "denied"
+	deviceStatusCancelled = "cancelled"
+	deviceStatusSuccess   = "success"
+	deviceStatusError     = "error"
+)
+
+// deviceSession tracks one device flow on the server, so polling follows the
+// interval GitHub asks for and the flow can be cancelled.
+type deviceSession struct {
+	mu        sync.Mutex
+	ID        string
+	code      *deviceCode
+	interval  time.Duration
+	expiresAt time.Time
+	nextPoll  time.Time
+	status    string
+	message   string
+}
+
+var deviceSessions = cache.New(15*time.Minute, 5*time.Minute)
+
+func newDeviceSession() (*deviceSession, error) {
+	dc, err := getDeviceCode()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &deviceSession{
+		ID:        randomID(16),
+		code:      dc,
+		interval:  time.Duration(dc.Interval) * time.Second,
+		expiresAt: now.Add(time.Duration(dc.ExpiresIn) * time.Second),
+		nextPoll:  now.Add(time.Duration(dc.Interval) * time.Second),
+		status:    deviceStatusPending,
+	}
+	deviceSessions.Set(s.ID, s, time.Duration(dc.ExpiresIn)*time.Second)
+	return s, nil
+}
+
+func findDeviceSession(id string) *deviceSession {
+	s, found := deviceSessions.Get(id)
+	if !found {
+		return nil
+	}
+	return s.(*deviceSession)
+}
+
+// poll asks GitHub for the token if the polling interval allows it. It
+// returns the session status and, on success, the token.
+func (s *deviceSession) poll() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.status {
+	case deviceStatusExpired, deviceStatusDenied, deviceStatusCancelled, deviceStatusError, deviceStatusSuccess:
+		return s.status, ""
+	}
+	now := time.Now()
+	if now.After(s.expiresAt) {
+		s.finish(deviceStatusExpired, "")
+		return s.status, ""
+	}
+	if now.Before(s.nextPoll) {
+		return s.status, ""
+	}
+
+	token, err := checkUserCode(s.code.DeviceCode)
+	s.nextPoll = time.Now().Add(s.interval)
+	if err == nil {
+		s.finish(deviceStatusSuccess, "")
+		return s.status, token
+	}
+
+	var flowErr *deviceFlowError
+	if !errors.As(err, &flowErr) {
+		// Network trouble; keep polling
+		s.message = err.Error()
+		return s.status, ""
+	}
+	s.message = flowErr.Description
+	switch flowErr.Code {
+	case errCodeAuthorizationPending:
+		s.status = deviceStatusPending
+	case errCodeSlowDown:
+		// RFC 8628 section 3.5: add 5 seconds unless told otherwise
+		s.interval += 5 * time.Second
+		if flowErr.Interval > 0 {
+			s.interval = time.Duration(flowErr.Interval) * time.Second
+		}
+		s.nextPoll = time.Now().Add(s.interval)
+		s.status = deviceStatusSlowDown
+	case errCodeExpiredToken:
+		s.finish(deviceStatusExpired, flowErr.Description)
+	case errCodeAccessDenied:
+		s.finish(deviceStatusDenied, flowErr.Description)
+	default:
+		s.finish(deviceStatusError, flowErr.Error())
+	}
+	return s.status, ""
+}
+
+func (s *deviceSession) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == deviceStatusPending || s.status == deviceStatusSlowDown {
+		s.finish(deviceStatusCancelled, "")
+	}
+}
+
+// fail ends a session whose token came through but couldn't be used.
+func (s *deviceSession) fail(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(deviceStatusError, message)
+}
+
+// finish moves the session to a terminal status. Callers must hold s.mu.
+// The session stays in deviceSessions until the device code expires, so
+// later checks report how it ended rather than that it expired.
+func (s *deviceSession) finish(status, message string) {
+	s.status = status
+	s.message = message
+}
+
+// state returns the values the /auth page needs to keep polling.
+func (s *deviceSession) state() (interval time.Duration, expiresIn time.Duration, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresIn = time.Until(s.expiresAt)
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+	return s.interval, expiresIn, s.message
+}
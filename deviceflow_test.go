@@ -0,0 +1,48 @@
+package gopilot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceSessionOutcomeKept(t *testing.T) {
+	tests := []struct {
+		name    string
+		end     func(s *deviceSession)
+		status  string
+		message string
+	}{
+		{"cancelled", func(s *deviceSession) { s.cancel() }, deviceStatusCancelled, ""},
+		{"denied", func(s *deviceSession) {
+			s.mu.Lock()
+			s.finish(deviceStatusDenied, "access denied")
+			s.mu.Unlock()
+		}, deviceStatusDenied, "access denied"},
+		{"registration failed", func(s *deviceSession) { s.fail("ghu 格式错误") }, deviceStatusError, "ghu 格式错误"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &deviceSession{
+				ID:        randomID(16),
+				code:      &deviceCode{},
+				expiresAt: time.Now().Add(time.Minute),
+				status:    deviceStatusPending,
+			}
+			deviceSessions.Set(s.ID, s, time.Minute)
+			t.Cleanup(func() { deviceSessions.Delete(s.ID) })
+
+			tt.end(s)
+			found := findDeviceSession(s.ID)
+			if found == nil {
+				t.Fatal("session gone before its code expired")
+			}
+			status, token := found.poll()
+			if status != tt.status || token != "" {
+				t.Errorf("poll = %q, %q, want %q", status, token, tt.status)
+			}
+			if _, _, message := found.state(); message != tt.message {
+				t.Errorf("message = %q, want %q", message, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package gopilot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// embeddingCache keeps single embeddings by model and input text, so a batch
+// only sends the inputs that weren't embedded before. It is on when
+// EMBEDDINGS_CACHE_DIR is set.
+var embeddingCache cacheBackend
+
+func loadEmbeddingCache() error {
+	dir := os.Getenv("EMBEDDINGS_CACHE_DIR")
+	if dir == "" {
+		embeddingCache = nil
+		return nil
+	}
+	maxSize, err := parseSize(GetEnvOrDefault("EMBEDDINGS_CACHE_MAX_SIZE", "1GB"))
+	if err != nil {
+		return fmt.Errorf("EMBEDDINGS_CACHE_MAX_SIZE: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("EMBEDDINGS_CACHE_DIR: %w", err)
+	}
+	embeddingCache = &diskCache{dir: dir, maxSize: maxSize}
+	return nil
+}
+
+// Batch limits for embeddings sent upstream. The input limit defaults to
+// the catalog's max_inputs for the model.
+var (
+	embeddingsMaxInputs   = getEnvInt("EMBEDDINGS_MAX_INPUTS", 0)
+	embeddingsMaxTokens   = getEnvInt("EMBEDDINGS_MAX_BATCH_TOKENS", 50000)
+	embeddingsConcurrency = getEnvInt("EMBEDDINGS_CONCURRENCY", 4)
+)
+
+// defaultEmbeddingsMaxInputs is used when neither EMBEDDINGS_MAX_INPUTS nor
+// the catalog give a limit.
+const defaultEmbeddingsMaxInputs = 512
+
+func getEnvInt(key string, defaultValue int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return n
+}
+
+// embeddingInputs splits the input of an embeddings request into single
+// inputs: strings or token arrays. It reports whether they are all text, the
+// only kind cached.
+func embeddingInputs(body map[string]interface{}) ([]interface{}, bool) {
+	switch input := body["input"].(type) {
+	case string:
+		return []interface{}{input}, true
+	case []interface{}:
+		if len(input) > 0 {
+			if _, ok := input[0].(float64); ok {
+				return []interface{}{input}, false
+			}
+		}
+		text := true
+		for _, v := range input {
+			if _, ok := v.(string); !ok {
+				text = false
+			}
+		}
+		return input, text
+	}
+	return nil, false
+}
+
+// inputTokens counts the tokens of one input.
+func inputTokens(model string, input interface{}) int {
+	switch v := input.(type) {
+	case string:
+		return countTokens(model, v)
+	case []interface{}:
+		return len(v)
+	}
+	return 0
+}
+
+// embeddingKey hashes one input together with the model.
+func embeddingKey(model, input string) string {
+	h := sha256.New()
+	io.WriteString(h, model+"\n")
+	io.WriteString(h, input)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// embedRequest answers an embeddings request. Inputs found in the embedding
+// cache are not sent again; the rest go upstream in batches within
+// Copilot's limits. dimensions and encoding_format, which Copilot ignores,
+// are applied to the vectors here. When upstream refuses a batch, its answer
+// is returned to relay instead of a list.
+func embedRequest(ctx context.Context, cred *credential, rt *route, body map[string]interface{}) (*embeddingList, *http.Response, string, error) {
+	inputs, text := embeddingInputs(body)
+	model := rt.models[0]
+	rt.apply(body, model)
+
+	keys := make([]string, len(inputs))
+	vectors := make([]json.RawMessage, len(inputs))
+	var missing, hits []int
+	for i, input := range inputs {
+		if embeddingCache != nil && text {
+			keys[i] = embeddingKey(model, input.(string))
+			if v, ok := embeddingCache.get(keys[i]); ok {
+				vectors[i] = v
+				hits = append(hits, i)
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+
+	list := &embeddingList{Object: "list", Model: model}
+	if len(missing) > 0 {
+		misses := make([]interface{}, len(missing))
+		for j, i := range missing {
+			misses[j] = inputs[i]
+		}
+		batches := batchInputs(model, misses)
+		// Vectors of different models can't be mixed, so only a request
+		// sent upstream in one piece may fall back.
+		batchRoute := rt
+		if len(hits) > 0 || len(batches) > 1 {
+			batchRoute = &route{rule: rt.rule, models: rt.models[:1]}
+		}
+		got, resp, m, err := embedBatches(ctx, cred, batchRoute, body, batches)
+		if err != nil || got == nil {
+			return nil, resp, m, err
+		}
+		model = m
+		list.Model = m
+		list.Usage = got.Usage
+		for j, v := range got.Data {
+			i := missing[j]
+			vectors[i] = v.Embedding
+			if keys[i] != "" && model == rt.models[0] {
+				embeddingCache.put(keys[i], v.Embedding)
+			}
+		}
+	}
+
+	dimensions, _ := body["dimensions"].(float64)
+	format, _ := body["encoding_format"].(string)
+	list.Data = make([]embeddingEntry, len(inputs))
+	for i, v := range vectors {
+		v, err := encodeEmbedding(v, int(dimensions), format)
+		if err != nil {
+			return nil, nil, model, fmt.Errorf("embedding %d: %w", i, err)
+		}
+		list.Data[i] = embeddingEntry{Object: "embedding", Index: i, Embedding: v}
+	}
+	// Cached inputs are counted locally so usage covers the whole request.
+	for _, i := range hits {
+		list.Usage.PromptTokens += inputTokens(model, inputs[i])
+	}
+	list.Usage.TotalTokens = list.Usage.PromptTokens
+	list.cached = len(hits)
+	return list, nil, model, nil
+}
+
+// batchInputs splits inputs into batches within the input count and token
+// limits. An input over the token limit on its own gets a batch of its own.
+func batchInputs(model string, inputs []interface{}) [][]interface{} {
+	maxInputs := embeddingsMaxInputs
+	if maxInputs <= 0 {
+		maxInputs = defaultEmbeddingsMaxInputs
+		if m, ok := catalog.lookup(model); ok && m.MaxInputs > 0 {
+			maxInputs = m.MaxInputs
+		}
+	}
+
+	var batches [][]interface{}
+	var batch []interface{}
+	tokens := 0
+	for _, input := range inputs {
+		n := inputTokens(model, input)
+		if len(batch) > 0 && (len(batch) >= maxInputs || embeddingsMaxTokens > 0 && tokens+n > embeddingsMaxTokens) {
+			batches = append(batches, batch)
+			batch, tokens = nil, 0
+		}
+		batch = append(batch, input)
+		tokens += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// embedBatches sends the batches upstream, a few at a time, and merges the
+// answers in input order with their usage summed. If a batch fails, the
+// first failure is returned instead.
+func embedBatches(ctx context.Context, cred *credential, rt *route, body map[string]interface{}, batches [][]interface{}) (*embeddingList, *http.Response, string, error) {
+	type result struct {
+		list  *embeddingList
+		resp  *http.Response
+		model string
+		err   error
+	}
+	results := make([]result, len(batches))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := make(chan struct{}, max(embeddingsConcurrency, 1))
+	var wg sync.WaitGroup
+	for b, batch := range batches {
+		upstream := make(map[string]interface{}, len(body))
+		for k, v := range body {
+			upstream[k] = v
+		}
+		delete(upstream, "dimensions")
+		delete(upstream, "encoding_format")
+		upstream["input"] = batch
+
+		wg.Add(1)
+		go func(b int, upstream map[string]interface{}) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			if ctx.Err() != nil {
+				results[b].err = ctx.Err()
+				return
+			}
+			r := &results[b]
+			r.list, r.resp, r.model, r.err = embedBatch(ctx, cred, rt, upstream, len(batches[b]))
+			if r.err != nil || r.list == nil {
+				cancel()
+			}
+		}(b, upstream)
+	}
+	wg.Wait()
+
+	// A failed batch cancels the others; report the failure, not the
+	// cancellations it caused.
+	for _, r := range results {
+		if r.resp != nil || r.err != nil && !errors.Is(r.err, context.Canceled) {
+			for _, other := range results {
+				if other.resp != nil && other.resp != r.resp {
+					other.resp.Body.Close()
+				}
+			}
+			return nil, r.resp, r.model, r.err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, "", err
+	}
+
+	merged := &embeddingList{Object: "list"}
+	for _, r := range results {
+		merged.Model = r.model
+		merged.Data = append(merged.Data, r.list.Data...)
+		merged.Usage.PromptTokens += r.list.Usage.PromptTokens
+	}
+	return merged, nil, merged.Model, nil
+}
+
+// embedBatch sends one batch of n inputs and returns its embeddings in
+// input order, or the answer when upstream refused it.
+func embedBatch(ctx context.Context, cred *credential, rt *route, body map[string]interface{}, n int) (*embeddingList, *http.Response, string, error) {
+	resp, model, err := sendRouted(ctx, cred, embeddingsUrl, rt, body)
+	if err != nil {
+		return nil, nil, model, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, model, nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, model, err
+	}
+	if data, err = normalizeEmbeddings(model)(data); err != nil {
+		return nil, nil, model, err
+	}
+	var list embeddingList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, nil, model, err
+	}
+	ordered := make([]embeddingEntry, n)
+	for _, e := range list.Data {
+		if e.Index < 0 || e.Index >= n || ordered[e.Index].Embedding != nil {
+			return nil, nil, model, fmt.Errorf("embedding index %d out of range", e.Index)
+		}
+		ordered[e.Index] = e
+	}
+	for i, e := range ordered {
+		if e.Embedding == nil {
+			return nil, nil, model, fmt.Errorf("no embedding for input %d", i)
+		}
+	}
+	list.Data = ordered
+	return &list, nil, list.Model, nil
+}
+
+// encodeEmbedding shortens a vector to dimensions, normalizing it to unit
+// length again, and encodes it as base64 little-endian float32 if asked.
+func encodeEmbedding(v json.RawMessage, dimensions int, format string) (json.RawMessage, error) {
+	if dimensions <= 0 && format != "base64" {
+		return v, nil
+	}
+	var vec []float64
+	if err := json.Unmarshal(v, &vec); err != nil {
+		return nil, err
+	}
+	if dimensions > 0 && dimensions < len(vec) {
+		vec = vec[:dimensions]
+		norm := 0.0
+		for _, x := range vec {
+			norm += x * x
+		}
+		if norm = math.Sqrt(norm); norm > 0 {
+			for i := range vec {
+				vec[i] /= norm
+			}
+		}
+	}
+	if format != "base64" {
+		return json.Marshal(vec)
+	}
+	buf := make([]byte, 4*len(vec))
+	for i, x := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(x)))
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(buf))
+}
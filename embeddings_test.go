@@ -0,0 +1,76 @@
+package gopilot
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// useUpstream answers upstream requests with fn for one test.
+func useUpstream(t *testing.T, fn roundTripFunc) {
+	t.Helper()
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = fn
+	t.Cleanup(func() { http.DefaultClient.Transport = old })
+	copilotTokens.Set("ghu_test", &copilotToken{Token: "tid=test", ExpiresAt: time.Now().Add(time.Hour)}, time.Hour)
+	t.Cleanup(func() { clearAccToken("ghu_test") })
+}
+
+func TestEmbedBatchesReportsFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing int
+	}{
+		{"cancelled batch first", 1},
+		{"failing batch first", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				var body struct{ Input []string }
+				json.NewDecoder(r.Body).Decode(&body)
+				if body.Input[0] != "bad" {
+					// Hang until the failing batch cancels this one.
+					close(started)
+					<-r.Context().Done()
+					return nil, r.Context().Err()
+				}
+				<-started
+				return &http.Response{
+					StatusCode: http.StatusTooManyRequests,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       io.NopCloser(strings.NewReader(`{"error":"slow down"}`)),
+					Request:    r,
+				}, nil
+			})
+
+			batches := [][]interface{}{{"good"}, {"good"}}
+			batches[tt.failing] = []interface{}{"bad"}
+			cred := &credential{token: "ghu_test"}
+			rt := &route{models: []string{"text-embedding-3-small"}}
+			list, resp, _, err := embedBatches(context.Background(), cred, rt, map[string]interface{}{}, batches)
+			if list != nil {
+				t.Fatal("got embeddings from a failed request")
+			}
+			if resp == nil {
+				t.Fatalf("no upstream answer, err = %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+			}
+			if b, _ := io.ReadAll(resp.Body); string(b) != `{"error":"slow down"}` {
+				t.Errorf("body = %s", b)
+			}
+		})
+	}
+}
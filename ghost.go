@@ -0,0 +1,380 @@
+package gopilot
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// codeCompletionsUrl is Copilot's inline completion engine. Business and
+// enterprise plans are served from another proxy host.
+var codeCompletionsUrl = GetEnvOrDefault("CODE_COMPLETIONS_URL", "https://copilot-proxy.githubusercontent.com/v1/engines/copilot-codex/completions")
+
+const ghostModel = "copilot-codex"
+
+// ghostRequest is an inline completion request from an editor plugin.
+type ghostRequest struct {
+	Prefix      string   `json:"prefix"`
+	Suffix      string   `json:"suffix"`
+	Language    string   `json:"language"`
+	Path        string   `json:"path"`
+	N           int      `json:"n"`
+	MaxTokens   int      `json:"max_tokens"`
+	Temperature *float64 `json:"temperature"`
+	TopP        *float64 `json:"top_p"`
+	Stop        []string `json:"stop"`
+	Stream      bool     `json:"stream"`
+	// Format is "openai" for text_completion objects, or "editor".
+	Format string `json:"format"`
+	// Group names the requests that supersede each other, defaulting to
+	// Path. A new request cancels the one still running in its group; see
+	// ghostGroup for who gets one.
+	Group string `json:"group"`
+}
+
+// upstreamBody builds the engine request. The engine is always asked to
+// stream so superseded requests stop early; non-stream answers are
+// collected here.
+func (g *ghostRequest) upstreamBody() ([]byte, error) {
+	prompt := g.Prefix
+	if g.Path != "" {
+		prompt = commentPrefix(g.Language, g.Path) + " Path: " + g.Path + "\n" + prompt
+	}
+	temperature := 0.0
+	if g.N > 1 {
+		temperature = 0.8
+	}
+	if g.Temperature != nil {
+		temperature = *g.Temperature
+	}
+	topP := 1.0
+	if g.TopP != nil {
+		topP = *g.TopP
+	}
+	stop := g.Stop
+	if stop == nil {
+		stop = []string{"\n\n\n"}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"prompt":      prompt,
+		"suffix":      g.Suffix,
+		"max_tokens":  g.MaxTokens,
+		"temperature": temperature,
+		"top_p":       topP,
+		"n":           g.N,
+		"stop":        stop,
+		"stream":      true,
+		"nwo":         "",
+		"extra": map[string]interface{}{
+			"language":            g.Language,
+			"next_indent":         0,
+			"trim_by_indentation": true,
+		},
+	})
+}
+
+// commentPrefix is the line comment marker of language, guessed from the
+// file extension when the language isn't given.
+func commentPrefix(language, file string) string {
+	if language == "" {
+		language = strings.TrimPrefix(path.Ext(file), ".")
+	}
+	switch strings.ToLower(language) {
+	case "python", "py", "ruby", "rb", "shellscript", "sh", "bash", "zsh", "perl", "pl", "r",
+		"yaml", "yml", "toml", "dockerfile", "makefile", "powershell", "ps1", "elixir", "ex", "exs":
+		return "#"
+	case "sql", "lua", "haskell", "hs":
+		return "--"
+	case "lisp", "clojure", "clj", "scheme":
+		return ";;"
+	default:
+		return "//"
+	}
+}
+
+// ghostHeaders are copilotHeaders as sent by the Copilot completion plugin
+// rather than Copilot Chat.
+func ghostHeaders(accToken string) map[string]string {
+	headers := copilotHeaders(accToken)
+	delete(headers, "Host")
+	delete(headers, "Copilot-Integration-Id")
+	headers["Openai-Intent"] = "copilot-ghost"
+	headers["Editor-Plugin-Version"] = "copilot/1.155.0"
+	headers["User-Agent"] = "GithubCopilot/1.155.0"
+	return headers
+}
+
+// ghostInFlight tracks the running request of every supersede group.
+var ghostInFlight = struct {
+	mu      sync.Mutex
+	cancels map[string]*context.CancelFunc
+}{cancels: map[string]*context.CancelFunc{}}
+
+// supersede cancels the request running in group and registers ctx in its
+// place. The returned func unregisters it again.
+func supersede(ctx context.Context, group string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if group == "" {
+		return ctx, cancel
+	}
+	own := &cancel
+
+	ghostInFlight.mu.Lock()
+	if prev, ok := ghostInFlight.cancels[group]; ok {
+		(*prev)()
+	}
+	ghostInFlight.cancels[group] = own
+	ghostInFlight.mu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		ghostInFlight.mu.Lock()
+		if ghostInFlight.cancels[group] == own {
+			delete(ghostInFlight.cancels, group)
+		}
+		ghostInFlight.mu.Unlock()
+	}
+}
+
+// ghostGroup keys a supersede group by caller, so clients sharing the
+// server never cancel each other. Callers are told apart by their client
+// key or their own GitHub token; anonymous callers of the pool can't be, so
+// their requests never supersede.
+func ghostGroup(cred *credential, g *ghostRequest) string {
+	group := g.Group
+	if group == "" {
+		group = g.Path
+	}
+	switch {
+	case group == "":
+		return ""
+	case cred.key != nil:
+		return "key:" + cred.key.ID + ":" + group
+	case cred.account == nil:
+		return "token:" + cred.token + ":" + group
+	default:
+		return ""
+	}
+}
+
+type editorCompletion struct {
+	Index        int     `json:"index"`
+	Text         string  `json:"text"`
+	FinishReason *string `json:"finish_reason,omitempty"`
+}
+
+// handleGhost serves inline code completions from Copilot's completion
+// engine, answering in the OpenAI completions shape or as editor JSON.
+func handleGhost(w http.ResponseWriter, r *http.Request) {
+	rec := &requestRecord{Time: time.Now(), Path: r.URL.Path, Model: ghostModel}
+	sw := newStatusRecorder(w)
+	w = sw
+	defer func() { requestLog.record(rec, sw) }()
+
+	var req ghostRequest
+	if !hooks.requestInto(w, r, &req) {
+		return
+	}
+	if f := r.URL.Query().Get("format"); f != "" {
+		req.Format = f
+	}
+	switch req.Format {
+	case "":
+		req.Format = "openai"
+	case "openai", "editor":
+	default:
+		http.Error(w, `format must be "openai" or "editor"`, http.StatusBadRequest)
+		return
+	}
+	if req.N < 1 {
+		req.N = 1
+	}
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = 500
+	}
+
+	fields := map[string]interface{}{"prompt": req.Prefix, "suffix": req.Suffix}
+	redacted, e := applyGuardrails(fields)
+	if e != nil {
+		writeRequestError(w, e)
+		return
+	}
+	if len(redacted) > 0 {
+		w.Header().Set("X-Gopilot-Redacted", strings.Join(redacted, ","))
+	}
+	req.Prefix, req.Suffix = fields["prompt"].(string), fields["suffix"].(string)
+
+	cred, ok := authorizeUpstream(w, r, rec, "")
+	if !ok {
+		return
+	}
+	failed := true
+	if cred.account != nil {
+		done := cred.account.begin()
+		defer func() { done(failed) }()
+	}
+
+	body, err := req.upstreamBody()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, release := supersede(r.Context(), ghostGroup(cred, &req))
+	defer release()
+	superseded := func() bool {
+		return ctx.Err() != nil && r.Context().Err() == nil
+	}
+
+	resp, err := sendUpstreamWith(ctx, cred, codeCompletionsUrl, body, ghostHeaders)
+	if err != nil {
+		if superseded() {
+			failed = false
+			http.Error(w, "superseded by a newer request", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), sendErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		log.Printf("代码补全失败：%d, %s ", resp.StatusCode, b)
+		http.Error(w, string(b), resp.StatusCode)
+		return
+	}
+
+	out := &completionResponse{
+		ID:      "cmpl-" + randomID(12),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   ghostModel,
+		Choices: []completionChoice{},
+	}
+
+	script := hooks.call(r.URL.Path)
+	if req.Stream {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		err = streamGhost(w, resp.Body, out, req.Format, script)
+		if err != nil && !superseded() {
+			log.Println("Error relaying code completion stream:", err)
+			return
+		}
+		failed = false
+		io.WriteString(w, "data: [DONE]\n\n")
+		return
+	}
+
+	parts := make([]strings.Builder, req.N)
+	finish := make([]*string, req.N)
+	err = scanSSE(resp.Body, func(data []byte) error {
+		for _, choice := range gjson.GetBytes(data, "choices").Array() {
+			i := int(choice.Get("index").Int())
+			if i < 0 || i >= req.N {
+				continue
+			}
+			parts[i].WriteString(choice.Get("text").String())
+			if f := choice.Get("finish_reason"); f.Type == gjson.String {
+				s := f.String()
+				finish[i] = &s
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if superseded() {
+			failed = false
+			http.Error(w, "superseded by a newer request", http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	failed = false
+
+	guard := newResponseGuard()
+	texts := make([]string, req.N)
+	for i := range parts {
+		texts[i], finish[i] = guard.complete(parts[i].String(), finish[i])
+	}
+
+	var answer interface{} = out
+	if req.Format == "editor" {
+		completions := make([]editorCompletion, req.N)
+		for i := range completions {
+			completions[i] = editorCompletion{Index: i, Text: texts[i], FinishReason: finish[i]}
+		}
+		answer = map[string]interface{}{"id": out.ID, "completions": completions}
+	} else {
+		for i := range texts {
+			out.Choices = append(out.Choices, completionChoice{Text: texts[i], Index: i, FinishReason: finish[i]})
+		}
+	}
+	data, err := json.Marshal(answer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if script != nil {
+		data = script.response(ghostModel, data)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
+
+// streamGhost relays the engine's stream, either as text_completion chunks
+// or as editorCompletion events, through the response hooks of script.
+func streamGhost(w http.ResponseWriter, body io.Reader, out *completionResponse, format string, script *hookCall) error {
+	send := func(c completionChoice) error {
+		var event interface{} = editorCompletion{Index: c.Index, Text: c.Text, FinishReason: c.FinishReason}
+		if format == "openai" {
+			chunk := *out
+			chunk.Choices = []completionChoice{c}
+			event = chunk
+		}
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return script.emit(w, ghostModel, b)
+	}
+
+	guard := newResponseGuard()
+	err := scanSSE(body, func(data []byte) error {
+		for _, choice := range gjson.GetBytes(data, "choices").Array() {
+			c := completionChoice{Index: int(choice.Get("index").Int())}
+			var finish *string
+			if f := choice.Get("finish_reason"); f.Type == gjson.String {
+				s := f.String()
+				finish = &s
+			}
+			c.Text, c.FinishReason = guard.text(c.Index, choice.Get("text").String(), finish)
+			if c.Text == "" && c.FinishReason == nil {
+				continue
+			}
+			if err := send(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, held := range guard.tail() {
+		if err := send(completionChoice{Text: *held.Delta.Content, Index: held.Index}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
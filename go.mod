@@ -3,12 +3,20 @@ module github.com/chadgpt/gopilot
 go 1.21.0
 
 require (
+	github.com/dop251/goja v0.0.0-20241024094426-79f3a7efcdbd
 	github.com/google/uuid v1.5.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/pkoukk/tiktoken-go v0.1.7
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/tidwall/gjson v1.17.0
+	golang.org/x/image v0.18.0
 )
 
 require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
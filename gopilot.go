@@ -1,32 +1,25 @@
 package gopilot
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/sha256"
+	"context"
 	"embed"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/google/uuid"
-	"github.com/patrickmn/go-cache"
-	"github.com/tidwall/gjson"
 )
 
 const tokenUrl = "https://api.github.com/copilot_internal/v2/token"
 const completionsUrl = "https://api.githubcopilot.com/chat/completions"
 const embeddingsUrl = "https://api.githubcopilot.com/embeddings"
 
-var requestUrl = ""
-
 type Model struct {
 	ID      string  `json:"id"`
 	Object  string  `json:"object"`
@@ -56,11 +49,24 @@ func GetEnvOrDefault(key, defaultValue string) string {
 	return value
 }
 
-func Run([]string) (err error) {
+func serve() (err error) {
 	log.Println("Server is running on port", port)
 	log.Println("client_id:", client_id)
 	log.Println("DEBUG:", os.Getenv("DEBUG") != "")
 
+	for _, a := range store.accounts() {
+		go func(a *Account) {
+			if err := a.refreshInfo(); err != nil {
+				log.Printf("account %s: %v", a.ID, err)
+			}
+		}(a)
+	}
+	go store.watch(5 * time.Second)
+	log.Println("accounts:", len(store.accounts()), "keys:", len(store.keys()))
+	if len(store.accounts()) == 0 {
+		log.Println("No upstream accounts; clients must send their own ghu token, or add one with `gopilot login` or /auth")
+	}
+
 	handler := Handler()
 	handler = DebugLoggingMiddleware(handler)
 	return http.ListenAndServe(":"+port, handler)
@@ -79,77 +85,117 @@ func Handler() http.Handler {
 		w.Header().Set("Cache-Control", "no-cache, must-revalidate")
 		w.Header().Set("Connection", "keep-alive")
 
-		requestUrl = completionsUrl
-		forwardRequest(w, r)
+		forwardRequest(w, r, completionsUrl)
 	})
 
 	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache, must-revalidate")
 		w.Header().Set("Connection", "keep-alive")
 
-		requestUrl = completionsUrl
-		forwardRequest(w, r)
+		forwardRequest(w, r, completionsUrl)
+	})
+
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache, must-revalidate")
+		w.Header().Set("Connection", "keep-alive")
+
+		handleCompletions(w, r)
 	})
 
+	mux.HandleFunc("/v1/code/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache, must-revalidate")
+		w.Header().Set("Connection", "keep-alive")
+
+		handleGhost(w, r)
+	})
+
+	mux.HandleFunc("/v1/tokenize", handleTokenize)
+	mux.HandleFunc("/v1/count_tokens", handleCountTokens)
+
 	mux.HandleFunc("/v1/embeddings", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache, must-revalidate")
 		w.Header().Set("Connection", "keep-alive")
 
-		requestUrl = embeddingsUrl
-		forwardRequest(w, r)
+		forwardRequest(w, r, embeddingsUrl)
 	})
 
+	mux.Handle("/admin/", adminHandler())
+
 	t, err := loadTemplate()
 	if err != nil {
 		panic(err)
 	}
 
+	dashboard := dashboardHandler(t)
+	mux.Handle("/dashboard", dashboard)
+	mux.Handle("/dashboard/", dashboard)
+
 	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
 		// 获取设备授权码
-		deviceCode, userCode, err := getDeviceCode()
+		session, err := newDeviceSession()
 		if err != nil {
 			fmt.Fprint(w, "获取设备码失败："+err.Error())
 			return
 		}
 
-		// 使用 deviceCode 和 userCode
-		fmt.Println("Device Code: ", deviceCode)
-		fmt.Println("User Code: ", userCode)
+		// 使用 userCode，deviceCode 只保存在服务端
+		fmt.Println("User Code: ", session.code.UserCode)
 
 		t.ExecuteTemplate(w, "auth.tmpl", map[string]interface{}{
-			"title":      "Get Copilot Token",
-			"deviceCode": deviceCode,
-			"userCode":   userCode,
+			"title":           "Get Copilot Token",
+			"session":         session.ID,
+			"userCode":        session.code.UserCode,
+			"verificationUri": session.code.VerificationURI,
+			"interval":        session.code.Interval,
+			"expiresIn":       session.code.ExpiresIn,
 		})
 	})
 
 	mux.HandleFunc("/auth/check", func(w http.ResponseWriter, r *http.Request) {
-		returnData := map[string]string{
-			"code": "1",
-			"msg":  "",
-			"data": "",
+		returnData := map[string]interface{}{
+			"code":   "1",
+			"msg":    "",
+			"data":   "",
+			"status": deviceStatusError,
 		}
 
-		deviceCode := r.FormValue("deviceCode")
-		if deviceCode == "" {
-			returnData["msg"] = "device code null"
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(returnData)
-			return
-		}
-		token, err := checkUserCode(deviceCode)
-		if err != nil {
-			returnData["msg"] = err.Error()
+		session := findDeviceSession(r.FormValue("session"))
+		if session == nil {
+			returnData["msg"] = "device session not found or expired"
+			returnData["status"] = deviceStatusExpired
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(returnData)
 			return
 		}
+
+		status, token := session.poll()
+		interval, expiresIn, message := session.state()
+		returnData["status"] = status
+		returnData["msg"] = message
+		returnData["interval"] = int(interval.Seconds())
+		returnData["expires_in"] = int(expiresIn.Seconds())
 		if token == "" {
-			returnData["msg"] = "token null"
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(returnData)
 			return
 		}
+
+		returnData["type"] = "ghu"
+		if authRegister {
+			secret, err := registerAuthToken(token)
+			if err != nil {
+				session.fail(err.Error())
+				returnData["status"] = deviceStatusError
+				returnData["msg"] = err.Error()
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(returnData)
+				return
+			}
+			if secret != "" {
+				token = secret
+				returnData["type"] = "key"
+			}
+		}
 		returnData["code"] = "0"
 		returnData["msg"] = "success"
 		returnData["data"] = token
@@ -158,6 +204,19 @@ func Handler() http.Handler {
 		return
 	})
 
+	mux.HandleFunc("/auth/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if session := findDeviceSession(r.FormValue("session")); session != nil {
+			session.cancel()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"code":   "0",
+			"msg":    "success",
+			"data":   "",
+			"status": deviceStatusCancelled,
+		})
+	})
+
 	mux.HandleFunc("/auth/checkGhu", func(w http.ResponseWriter, r *http.Request) {
 		returnData := map[string]string{
 			"code": "1",
@@ -189,7 +248,7 @@ func Handler() http.Handler {
 		return
 	})
 
-	return mux
+	return hooks.wrap(mux)
 }
 
 type loggingResponseWriter struct {
@@ -207,124 +266,253 @@ func (lrw *loggingResponseWriter) Write(data []byte) (int, error) {
 	return n, err
 }
 
-func forwardRequest(w http.ResponseWriter, r *http.Request) {
+func forwardRequest(w http.ResponseWriter, r *http.Request, upstreamUrl string) {
+	rec := &requestRecord{Time: time.Now(), Path: r.URL.Path}
+	sw := newStatusRecorder(w)
+	w = sw
+	defer func() { requestLog.record(rec, sw) }()
+
+	data, err := io.ReadAll(r.Body)
 	var jsonBody map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&jsonBody); err != nil {
+	if err != nil || json.Unmarshal(data, &jsonBody) != nil || jsonBody == nil {
 		http.Error(w, "Request body is missing or not in JSON format", http.StatusBadRequest)
 		return
 	}
+	rec.Model, _ = jsonBody["model"].(string)
 
-	if ghuToken == "" {
-		ghuToken = strings.Split(r.Header.Get("Authorization"), " ")[1]
+	validate := validateChat
+	if upstreamUrl == embeddingsUrl {
+		validate = validateEmbeddings
 	}
-
-	if !strings.HasPrefix(ghuToken, "gh") {
-		http.Error(w, "auth token not found", http.StatusBadRequest)
-		log.Printf("token 格式错误：%s\n", ghuToken)
+	if e := validate(data, strings.HasPrefix(r.URL.Path, "/v1/")); e != nil {
+		writeRequestError(w, e)
 		return
 	}
-
-	// 检查 token 是否有效
-	if !checkToken(ghuToken) {
-		http.Error(w, "auth token is invalid", http.StatusBadRequest)
-		log.Printf("token 无效：%s\n", ghuToken)
+	changed, e := applyRequestPolicy(jsonBody)
+	if e != nil {
+		writeRequestError(w, e)
+		return
+	}
+	if len(changed) > 0 {
+		w.Header().Set("X-Gopilot-Rewritten", strings.Join(changed, ","))
+	}
+	body, reply, err := hooks.request(r, jsonBody)
+	if err != nil {
+		log.Printf("onRequest 出错：%v", err)
+		http.Error(w, "request hook failed", http.StatusInternalServerError)
+		return
+	}
+	if reply != nil {
+		reply.write(w)
 		return
 	}
-	accToken, err := getAccToken(ghuToken)
-	if accToken == "" {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	jsonBody = body
+	rec.Model, _ = jsonBody["model"].(string)
+	// Guardrails run after the hooks, so what goes upstream is checked.
+	redacted, e := applyGuardrails(jsonBody)
+	if e != nil {
+		writeRequestError(w, e)
+		return
+	}
+	if len(redacted) > 0 {
+		w.Header().Set("X-Gopilot-Redacted", strings.Join(redacted, ","))
+	}
+	rt := routes.resolve(rec.Model)
+	if !validTruncateMode(r.Header.Get("X-Gopilot-Truncate")) {
+		writeRequestError(w, paramError("X-Gopilot-Truncate", "must be off, middle-out or summarize"))
+		return
+	}
+	if !validCacheMode(r.Header.Get("X-Gopilot-Cache")) {
+		writeRequestError(w, paramError("X-Gopilot-Cache", "must be on or off"))
 		return
 	}
 
-	sessionId := fmt.Sprintf("%s%d", uuid.New().String(), time.Now().UnixNano()/int64(time.Millisecond))
-	machineID := sha256.Sum256([]byte(uuid.New().String()))
-	machineIDStr := hex.EncodeToString(machineID[:])
-	accHeaders := getAccHeaders(accToken, uuid.New().String(), sessionId, machineIDStr)
-	client := &http.Client{}
+	cred, ok := authorizeUpstream(w, r, rec, rt.group())
+	if !ok {
+		return
+	}
 
-	jsonData, err := json.Marshal(jsonBody)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	call := &upstreamCall{cred: cred, url: upstreamUrl, rt: rt, body: jsonBody, path: r.URL.Path}
+	if upstreamUrl == completionsUrl {
+		if e := prepareImages(r.Context(), rt.models[0], jsonBody); e != nil {
+			writeRequestError(w, e)
+			return
+		}
+		call.tools = adaptTools(rt.models[0], jsonBody)
+		if call.schema, e = structuredFormat(jsonBody); e != nil {
+			writeRequestError(w, e)
+			return
+		}
+		call.schema.inject(rt.models[0], jsonBody)
+		mode := truncateMode(r, rt, cred)
+		if t := fitContext(r.Context(), cred, rt.models[0], mode, jsonBody); t != nil {
+			setTruncationHeaders(w, t)
+		}
+		if e := checkPromptSize(rt.models[0], jsonBody); e != nil {
+			writeRequestError(w, e)
+			return
+		}
+		rt.dropIncompatible(jsonBody)
+	}
+
+	isStream, _ := jsonBody["stream"].(bool)
+	rt.apply(jsonBody, rt.models[0])
+	call.key = cacheKey(cacheMode(r, cred), upstreamUrl, rt.models[0], jsonBody)
+	if call.key != "" {
+		call.key += call.tools.variant()
+	}
+	if hit, ok := lookupCache(call.key); ok && serveCached(w, hit, isStream, newChatNormalizer(hit.Model, jsonBody)) {
+		rec.Model = hit.Model
 		return
 	}
+	if call.key != "" {
+		w.Header().Set("X-Gopilot-Cache", "miss")
+	}
 
-	isStream := gjson.GetBytes(jsonData, "stream").String() == "true"
+	if ck := coalesceKey(r, cred, rt, upstreamUrl, jsonBody); ck != "" {
+		coalesce(w, r, ck+call.tools.variant(), func(ctx context.Context, w http.ResponseWriter) {
+			relayUpstream(ctx, w, call)
+		})
+		return
+	}
+	relayUpstream(r.Context(), w, call)
+}
 
-	req, err := http.NewRequest("POST", requestUrl, bytes.NewBuffer(jsonData))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// upstreamCall is a checked request, ready to go upstream.
+type upstreamCall struct {
+	cred *credential
+	url  string
+	rt   *route
+	body map[string]interface{}
+	// path is the client's request path, for the response hooks.
+	path string
+	// key is the response cache key, "" when the answer isn't cached.
+	key    string
+	tools  *toolShim
+	schema *structuredOutput
+}
+
+func (c *upstreamCall) normalizer(model string) *chatNormalizer {
+	norm := newChatNormalizer(model, c.body)
+	norm.tools = c.tools
+	norm.guard = newResponseGuard()
+	norm.script = hooks.call(c.path)
+	return norm
+}
+
+// relayUpstream sends a request upstream and relays the answer, storing it
+// under the response cache key if there is one.
+func relayUpstream(ctx context.Context, w http.ResponseWriter, call *upstreamCall) {
+	cred, upstreamUrl, rt, jsonBody, key := call.cred, call.url, call.rt, call.body, call.key
+	failed := true
+	if cred.account != nil {
+		done := cred.account.begin()
+		defer func() { done(failed) }()
 	}
 
-	for key, value := range accHeaders {
-		req.Header.Add(key, value)
+	isStream, _ := jsonBody["stream"].(bool)
+	if call.schema.enforced(isStream) {
+		out, model, ok := relayStructured(ctx, w, call)
+		failed = !ok
+		storeCache(key, model, out)
+		return
+	}
+	if call.schema != nil {
+		w.Header().Set("X-Gopilot-Schema", "unchecked")
 	}
 
-	resp, err := client.Do(req)
+	var resp *http.Response
+	var model string
+	var embeddings *embeddingList
+	var err error
+	if upstreamUrl == embeddingsUrl {
+		embeddings, resp, model, err = embedRequest(ctx, cred, rt, jsonBody)
+	} else {
+		resp, model, err = sendRouted(ctx, cred, upstreamUrl, rt, jsonBody)
+	}
+	if resp != nil {
+		defer resp.Body.Close()
+	}
 	if err != nil {
+		http.Error(w, err.Error(), sendErrorStatus(err))
 		return
 	}
-	defer resp.Body.Close()
+	w.Header().Set("X-Gopilot-Model", model)
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal(err)
-		}
-		bodyString := string(bodyBytes)
-		log.Printf("对话失败：%d, %s ", resp.StatusCode, bodyString)
-		cache := cache.New(5*time.Minute, 10*time.Minute)
-		cache.Delete(ghuToken)
-		http.Error(w, bodyString, resp.StatusCode)
+	if resp != nil && resp.StatusCode != http.StatusOK {
+		relayUpstreamError(w, resp)
 		return
 	}
 
+	failed = false
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	if isStream {
-		returnStream(w, resp)
-	} else {
-		returnJson(w, resp)
+	norm := call.normalizer(model)
+	switch {
+	case embeddings != nil:
+		w.Header().Set("X-Gopilot-Embeddings-Cached", strconv.Itoa(embeddings.cached))
+		out, err := json.Marshal(embeddings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if norm.script != nil {
+			out = norm.script.response(model, out)
+		}
+		w.Write(out)
+		storeCache(key, model, out)
+	case isStream:
+		relayChatStream(w, resp, norm)
+	default:
+		storeCache(key, model, relayChatJSON(w, resp, norm))
 	}
-	return
 }
 
-func returnJson(w http.ResponseWriter, resp *http.Response) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-
-	body, err := io.ReadAll(resp.Body.(io.Reader))
+// relayUpstreamError relays a failed upstream answer to the client.
+func relayUpstreamError(w http.ResponseWriter, resp *http.Response) {
+	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-
-	w.Write(body)
+	bodyString := string(bodyBytes)
+	log.Printf("对话失败：%d, %s ", resp.StatusCode, bodyString)
+	http.Error(w, bodyString, resp.StatusCode)
 }
 
-func returnStream(w http.ResponseWriter, resp *http.Response) {
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-
-	// 创建一个新的扫描器
-	scanner := bufio.NewScanner(resp.Body)
-
-	// 使用Scan方法来读取流
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// 替换 "content":null 为 "content":""
-		modifiedLine := strings.ReplaceAll(line, `"content":null`, `"content":""`) + "\n"
-
-		// 将修改后的数据写入响应体
-		if _, err := io.WriteString(w, modifiedLine); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// authorizeUpstream picks the credential for r, from the account group if
+// one is given, and checks it, answering the client itself when that fails.
+func authorizeUpstream(w http.ResponseWriter, r *http.Request, rec *requestRecord, group string) (*credential, bool) {
+	cred, err := authorize(r, group)
+	if err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, errNoAccount) {
+			status = http.StatusServiceUnavailable
 		}
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	ghuToken := cred.token
+	if cred.key != nil {
+		rec.KeyID = cred.key.ID
+	}
+	if cred.account != nil {
+		rec.Account = cred.account.ID
 	}
 
-	if scanner.Err() != nil {
-		// 处理来自扫描器的任何错误
-		http.Error(w, scanner.Err().Error(), http.StatusInternalServerError)
-		log.Println("Error reading from scanner:", scanner.Err())
+	if !strings.HasPrefix(ghuToken, "gh") {
+		http.Error(w, "auth token not found", http.StatusBadRequest)
+		log.Printf("token 格式错误：%s\n", maskSecret(ghuToken))
+		return nil, false
+	}
+
+	// 检查 token 是否有效
+	if _, found := cachedAccToken(ghuToken); !found && cred.account == nil && !checkToken(ghuToken) {
+		http.Error(w, "auth token is invalid", http.StatusBadRequest)
+		log.Printf("token 无效：%s\n", maskSecret(ghuToken))
+		return nil, false
 	}
+	return cred, true
 }
 
 func loadTemplate() (*template.Template, error) {
@@ -0,0 +1,710 @@
+package gopilot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var guardrailsPath = GetEnvOrDefault("GUARDRAILS_PATH", "guardrails.json")
+
+// Guardrail actions.
+const (
+	guardBlock  = "block"
+	guardRedact = "redact"
+	guardLog    = "log"
+)
+
+// guardrailRule configures one filter of the pipeline that checks prompts
+// before they go upstream and answers before they reach the client.
+//
+//	{"type": "secrets", "action": "block", "on": "request"},
+//	{"type": "pii", "action": "redact", "kinds": ["email", "credit_card"]},
+//	{"type": "terms", "action": "block", "terms": ["Project Falcon"]}
+type guardrailRule struct {
+	// Type is secrets, pii, terms or regex.
+	Type string `json:"type"`
+	// Name shows in logs, errors and headers; the type if empty.
+	Name   string `json:"name,omitempty"`
+	Action string `json:"action"`
+	// On is request or response; empty means both.
+	On string `json:"on,omitempty"`
+	// Kinds limits pii to some of email, phone, credit_card, ssn and iban.
+	Kinds []string `json:"kinds,omitempty"`
+	// Terms are matched as whole words, ignoring case.
+	Terms []string `json:"terms,omitempty"`
+	// Patterns are extra regexps by kind. When one has a group, only the
+	// first group is matched, e.g. the value after "password=".
+	Patterns map[string]string `json:"patterns,omitempty"`
+	// Entropy is the bits per character above which secrets flags long
+	// random-looking tokens, 4.2 if zero; negative turns it off.
+	Entropy float64 `json:"entropy,omitempty"`
+}
+
+// guardFilter finds sensitive text.
+type guardFilter interface {
+	find(text string) []guardMatch
+}
+
+// guardMatch is a span of text a filter flagged, by byte offsets.
+type guardMatch struct {
+	start, end int
+	kind       string
+}
+
+// guardFilterTypes builds the filter of each rule type.
+var guardFilterTypes = map[string]func(rule *guardrailRule) (guardFilter, error){
+	"secrets": newSecretFilter,
+	"pii":     newPIIFilter,
+	"terms":   newTermFilter,
+	"regex":   newRegexFilter,
+}
+
+type guardrail struct {
+	name     string
+	action   string
+	request  bool
+	response bool
+	filter   guardFilter
+}
+
+// guardrails is the pipeline from GUARDRAILS_PATH, empty if the file
+// doesn't exist.
+var guardrails []*guardrail
+
+func loadGuardrails(path string) error {
+	var rules []*guardrailRule
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	var list []*guardrail
+	for i, rule := range rules {
+		g, err := newGuardrail(rule)
+		if err != nil {
+			return fmt.Errorf("%s: guardrail %d: %w", path, i, err)
+		}
+		list = append(list, g)
+	}
+	guardrails = list
+	return nil
+}
+
+func newGuardrail(rule *guardrailRule) (*guardrail, error) {
+	build := guardFilterTypes[rule.Type]
+	if build == nil {
+		return nil, fmt.Errorf("unknown type %q", rule.Type)
+	}
+	switch rule.Action {
+	case guardBlock, guardRedact, guardLog:
+	default:
+		return nil, fmt.Errorf("invalid action %q, want block, redact or log", rule.Action)
+	}
+	g := &guardrail{name: rule.Name, action: rule.Action}
+	if g.name == "" {
+		g.name = rule.Type
+	}
+	switch rule.On {
+	case "":
+		g.request, g.response = true, true
+	case "request":
+		g.request = true
+	case "response":
+		g.response = true
+	default:
+		return nil, fmt.Errorf("invalid on %q, want request or response", rule.On)
+	}
+	filter, err := build(rule)
+	if err != nil {
+		return nil, err
+	}
+	g.filter = filter
+	return g, nil
+}
+
+// patternFilter matches regexps, optionally checking each match, and for
+// secrets also flags high-entropy tokens.
+type patternFilter struct {
+	patterns []guardPattern
+	entropy  float64
+}
+
+type guardPattern struct {
+	kind  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+var secretPatterns = []guardPattern{
+	{kind: "private_key", re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z ]*PRIVATE KEY-----|$)`)},
+	{kind: "aws_access_key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{kind: "github_token", re: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+	{kind: "openai_key", re: regexp.MustCompile(`\bsk-(?:proj-)?[A-Za-z0-9_-]{20,}`)},
+	{kind: "slack_token", re: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{kind: "google_api_key", re: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+	{kind: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{kind: "password", re: regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|secret|api[_-]?key|access[_-]?token)\s*[:=]\s*["']?([^\s"']{6,})`)},
+}
+
+var piiPatterns = map[string]guardPattern{
+	"email":       {re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	"phone":       {re: regexp.MustCompile(`(?:\+\d{1,3}[\s-]?)?(?:\(\d{2,4}\)\s?|\b\d{2,4}[\s-])\d{3,4}[\s-]\d{3,4}\b`)},
+	"credit_card": {re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	"ssn":         {re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	"iban":        {re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`), valid: ibanChecksum},
+}
+
+// entropyToken is what the entropy check looks at: long runs of the
+// characters keys and tokens are made of.
+var entropyToken = regexp.MustCompile(`[A-Za-z0-9+/=_-]{24,}`)
+
+func newSecretFilter(rule *guardrailRule) (guardFilter, error) {
+	f := &patternFilter{patterns: append([]guardPattern(nil), secretPatterns...), entropy: rule.Entropy}
+	if f.entropy == 0 {
+		f.entropy = 4.2
+	}
+	return f, f.addPatterns(rule.Patterns)
+}
+
+func newPIIFilter(rule *guardrailRule) (guardFilter, error) {
+	kinds := rule.Kinds
+	if len(kinds) == 0 {
+		for kind := range piiPatterns {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+	}
+	f := &patternFilter{entropy: -1}
+	for _, kind := range kinds {
+		p, ok := piiPatterns[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown pii kind %q", kind)
+		}
+		p.kind = kind
+		f.patterns = append(f.patterns, p)
+	}
+	return f, f.addPatterns(rule.Patterns)
+}
+
+func newTermFilter(rule *guardrailRule) (guardFilter, error) {
+	if len(rule.Terms) == 0 {
+		return nil, errors.New("terms is required")
+	}
+	f := &patternFilter{entropy: -1}
+	alts := make([]string, 0, len(rule.Terms))
+	for _, term := range rule.Terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		alt := regexp.QuoteMeta(term)
+		if r, _ := utf8.DecodeRuneInString(term); isWordRune(r) {
+			alt = `\b` + alt
+		}
+		if r, _ := utf8.DecodeLastRuneInString(term); isWordRune(r) {
+			alt += `\b`
+		}
+		alts = append(alts, alt)
+	}
+	if len(alts) == 0 {
+		return nil, errors.New("terms is required")
+	}
+	f.patterns = []guardPattern{{kind: "term", re: regexp.MustCompile(`(?i)(?:` + strings.Join(alts, "|") + `)`)}}
+	return f, f.addPatterns(rule.Patterns)
+}
+
+func newRegexFilter(rule *guardrailRule) (guardFilter, error) {
+	if len(rule.Patterns) == 0 {
+		return nil, errors.New("patterns is required")
+	}
+	f := &patternFilter{entropy: -1}
+	return f, f.addPatterns(rule.Patterns)
+}
+
+func (f *patternFilter) addPatterns(patterns map[string]string) error {
+	kinds := make([]string, 0, len(patterns))
+	for kind := range patterns {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		re, err := regexp.Compile(patterns[kind])
+		if err != nil {
+			return fmt.Errorf("pattern %s: %w", kind, err)
+		}
+		f.patterns = append(f.patterns, guardPattern{kind: kind, re: re})
+	}
+	return nil
+}
+
+func (f *patternFilter) find(text string) []guardMatch {
+	var matches []guardMatch
+	for _, p := range f.patterns {
+		for _, loc := range p.re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := loc[0], loc[1]
+			if len(loc) >= 4 && loc[2] >= 0 {
+				start, end = loc[2], loc[3]
+			}
+			if p.valid != nil && !p.valid(text[start:end]) {
+				continue
+			}
+			matches = append(matches, guardMatch{start: start, end: end, kind: p.kind})
+		}
+	}
+	if f.entropy > 0 {
+		for _, loc := range entropyToken.FindAllStringIndex(text, -1) {
+			token := text[loc[0]:loc[1]]
+			if strings.ContainsAny(token, "0123456789") && strings.IndexFunc(token, unicode.IsLetter) >= 0 && entropy(token) >= f.entropy {
+				matches = append(matches, guardMatch{start: loc[0], end: loc[1], kind: "high_entropy"})
+			}
+		}
+	}
+	return matches
+}
+
+// entropy is the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+	h := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && n <= 19 && sum%10 == 0
+}
+
+func ibanChecksum(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	s = s[4:] + s[:4]
+	rem := 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			rem = (rem*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			rem = (rem*100 + int(c-'A'+10)) % 97
+		default:
+			return false
+		}
+	}
+	return rem == 1
+}
+
+// isWordRune reports whether \b works next to r; it only knows ASCII.
+func isWordRune(r rune) bool {
+	return r == '_' || r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// guardHit is a match of a guardrail, by name, action and kind.
+type guardHit struct {
+	guardMatch
+	name   string
+	action string
+}
+
+func (h guardHit) String() string {
+	return h.name + "/" + h.kind
+}
+
+// scanGuardrails runs the guardrails for one side over text.
+func scanGuardrails(text string, response bool) []guardHit {
+	var hits []guardHit
+	for _, g := range guardrails {
+		if response && !g.response || !response && !g.request {
+			continue
+		}
+		for _, m := range g.filter.find(text) {
+			hits = append(hits, guardHit{guardMatch: m, name: g.name, action: g.action})
+		}
+	}
+	return hits
+}
+
+// firstBlock returns the first hit of a blocking guardrail.
+func firstBlock(hits []guardHit) (guardHit, bool) {
+	for _, h := range hits {
+		if h.action == guardBlock {
+			return h, true
+		}
+	}
+	return guardHit{}, false
+}
+
+// redactHits replaces the redact hits that end before limit with their
+// kind, and logs the log hits, returning the names of the guardrails that
+// redacted something.
+func redactHits(text string, hits []guardHit, limit int, where string) (string, []string) {
+	var spans []guardHit
+	var names []string
+	for _, h := range hits {
+		if h.end > limit {
+			continue
+		}
+		switch h.action {
+		case guardRedact:
+			spans = append(spans, h)
+			names = appendUnique(names, h.name)
+		case guardLog:
+			log.Printf("guardrail %s：在 %s 发现 %s", h.name, where, h.kind)
+		}
+	}
+	if len(spans) == 0 {
+		return text, nil
+	}
+	// Overlapping spans are replaced once, named after the longest that
+	// starts first.
+	sort.Slice(spans, func(a, b int) bool {
+		if spans[a].start != spans[b].start {
+			return spans[a].start < spans[b].start
+		}
+		return spans[a].end > spans[b].end
+	})
+	var out strings.Builder
+	last := 0
+	for _, s := range spans {
+		if s.start < last {
+			last = max(last, s.end)
+			continue
+		}
+		out.WriteString(text[last:s.start])
+		out.WriteString("[REDACTED:" + s.kind + "]")
+		last = s.end
+	}
+	out.WriteString(text[last:])
+	return out.String(), names
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// applyGuardrails runs the request guardrails over the text of a chat,
+// completions, code completions or embeddings request, redacting it in place. It returns the
+// guardrails that redacted something, or an error if one blocks the
+// request. The offending text is never logged or echoed.
+func applyGuardrails(body map[string]interface{}) ([]string, *requestError) {
+	if len(guardrails) == 0 {
+		return nil, nil
+	}
+	var redacted []string
+	var blocked *requestError
+	check := func(param, text string) string {
+		if blocked != nil {
+			return text
+		}
+		hits := scanGuardrails(text, false)
+		if h, ok := firstBlock(hits); ok {
+			blocked = &requestError{
+				Param:   param,
+				Code:    "content_blocked",
+				Message: fmt.Sprintf("The request was blocked by guardrail %s: %s found.", h.name, h.kind),
+			}
+			return text
+		}
+		out, names := redactHits(text, hits, len(text), param)
+		for _, name := range names {
+			redacted = appendUnique(redacted, name)
+		}
+		return out
+	}
+
+	messages, _ := body["messages"].([]interface{})
+	for i, m := range messages {
+		msg, _ := m.(map[string]interface{})
+		param := fmt.Sprintf("messages[%d].content", i)
+		switch content := msg["content"].(type) {
+		case string:
+			msg["content"] = check(param, content)
+		case []interface{}:
+			for j, p := range content {
+				if part, _ := p.(map[string]interface{}); part["type"] == "text" {
+					if text, ok := part["text"].(string); ok {
+						part["text"] = check(fmt.Sprintf("%s[%d].text", param, j), text)
+					}
+				}
+			}
+		}
+		calls, _ := msg["tool_calls"].([]interface{})
+		for j, c := range calls {
+			call, _ := c.(map[string]interface{})
+			f, _ := call["function"].(map[string]interface{})
+			if args, ok := f["arguments"].(string); ok {
+				f["arguments"] = check(fmt.Sprintf("messages[%d].tool_calls[%d].function.arguments", i, j), args)
+			}
+		}
+	}
+	for _, field := range []string{"prompt", "suffix", "input"} {
+		switch v := body[field].(type) {
+		case string:
+			body[field] = check(field, v)
+		case []interface{}:
+			for i, s := range v {
+				if s, ok := s.(string); ok {
+					v[i] = check(fmt.Sprintf("%s[%d]", field, i), s)
+				}
+			}
+		}
+	}
+	return redacted, blocked
+}
+
+// guardHoldback is how much streamed text is held back so matches split
+// over chunks are still found.
+const guardHoldback = 128
+
+// responseGuard runs the response guardrails over a chat answer, its text
+// and the arguments of its tool calls. Blocked answers end with
+// finish_reason content_filter.
+type responseGuard struct {
+	streams map[int]*guardStream
+}
+
+type guardStream struct {
+	pending string
+	// args holds back the arguments of each streamed tool call.
+	args    map[int]string
+	blocked bool
+}
+
+// newResponseGuard returns nil when no guardrail checks answers.
+func newResponseGuard() *responseGuard {
+	for _, g := range guardrails {
+		if g.response {
+			return &responseGuard{streams: map[int]*guardStream{}}
+		}
+	}
+	return nil
+}
+
+// message checks a complete answer.
+func (g *responseGuard) message(choice *chatChoice) {
+	m := choice.Message
+	fields := []*string{m.Content}
+	for i := range m.ToolCalls {
+		fields = append(fields, &m.ToolCalls[i].Function.Arguments)
+	}
+	if m.FunctionCall != nil {
+		fields = append(fields, &m.FunctionCall.Arguments)
+	}
+	hits := make([][]guardHit, len(fields))
+	for i, f := range fields {
+		if f == nil {
+			continue
+		}
+		hits[i] = scanGuardrails(*f, true)
+		if h, ok := firstBlock(hits[i]); ok {
+			log.Printf("guardrail %s 拦截了回答：%s", h.name, h.kind)
+			filtered(choice, m)
+			return
+		}
+	}
+	for i, f := range fields {
+		if f != nil {
+			*f, _ = redactHits(*f, hits[i], len(*f), "response")
+		}
+	}
+}
+
+// delta checks one streamed choice, passing on the text and tool call
+// arguments no match can still reach into.
+func (g *responseGuard) delta(choice *chatChoice) {
+	d := choice.Delta
+	s := g.streams[choice.Index]
+	if s == nil {
+		s = &guardStream{args: map[int]string{}}
+		g.streams[choice.Index] = s
+	}
+	if s.blocked {
+		empty := ""
+		d.Content, d.ToolCalls, choice.FinishReason = &empty, nil, nil
+		return
+	}
+	if d.Content != nil {
+		s.pending += *d.Content
+	}
+	for j, call := range d.ToolCalls {
+		s.args[toolCallIndex(call, j)] += call.Function.Arguments
+	}
+	hits := scanGuardrails(s.pending, true)
+	h, block := firstBlock(hits)
+	argHits := make(map[int][]guardHit, len(s.args))
+	for i, args := range s.args {
+		argHits[i] = scanGuardrails(args, true)
+		if !block {
+			h, block = firstBlock(argHits[i])
+		}
+	}
+	if block {
+		log.Printf("guardrail %s 拦截了回答：%s", h.name, h.kind)
+		s.blocked = true
+		s.pending, s.args = "", nil
+		filtered(choice, d)
+		return
+	}
+
+	final := choice.FinishReason != nil
+	text, rest := releaseHeld(s.pending, hits, final)
+	s.pending = rest
+	d.Content = &text
+
+	calls := d.ToolCalls[:0]
+	for j, call := range d.ToolCalls {
+		i := toolCallIndex(call, j)
+		call.Function.Arguments, s.args[i] = releaseHeld(s.args[i], argHits[i], final)
+		// Arguments still held back leave nothing to send for now.
+		if call.Function.Arguments != "" || call.ID != "" || call.Function.Name != "" {
+			calls = append(calls, call)
+		}
+	}
+	if final {
+		calls = append(calls, s.flushArgs(argHits)...)
+	}
+	d.ToolCalls = calls
+}
+
+// releaseHeld splits pending into what can go out, redacted, and what is
+// still held back: everything goes at the end of a stream, else only what
+// no match can still reach into.
+func releaseHeld(pending string, hits []guardHit, final bool) (string, string) {
+	cut := len(pending)
+	if !final {
+		cut = max(cut-guardHoldback, 0)
+		for moved := true; moved; {
+			moved = false
+			for _, h := range hits {
+				if h.start < cut && h.end > cut {
+					cut, moved = h.start, true
+				}
+			}
+		}
+		for cut > 0 && !utf8.RuneStart(pending[cut]) {
+			cut--
+		}
+	}
+	out, _ := redactHits(pending[:cut], hits, cut, "response")
+	return out, pending[cut:]
+}
+
+// flushArgs returns the held back arguments of the tool calls in hits as
+// tool call deltas.
+func (s *guardStream) flushArgs(hits map[int][]guardHit) []responseToolCall {
+	var calls []responseToolCall
+	for i, h := range hits {
+		if s.args[i] == "" {
+			continue
+		}
+		index := i
+		args, _ := releaseHeld(s.args[i], h, true)
+		s.args[i] = ""
+		calls = append(calls, responseToolCall{Index: &index, Function: responseFunction{Arguments: args}})
+	}
+	sort.Slice(calls, func(a, b int) bool { return *calls[a].Index < *calls[b].Index })
+	return calls
+}
+
+// toolCallIndex is the index of a streamed tool call, its position in the
+// delta when upstream leaves it out.
+func toolCallIndex(call responseToolCall, pos int) int {
+	if call.Index != nil {
+		return *call.Index
+	}
+	return pos
+}
+
+// tail ends the streams that never saw a finish reason, returning the
+// choices with the text and arguments still held back.
+func (g *responseGuard) tail() []chatChoice {
+	if g == nil {
+		return nil
+	}
+	var choices []chatChoice
+	for index, s := range g.streams {
+		if s.blocked {
+			continue
+		}
+		hits := make(map[int][]guardHit, len(s.args))
+		for i, args := range s.args {
+			hits[i] = scanGuardrails(args, true)
+		}
+		calls := s.flushArgs(hits)
+		if s.pending == "" && len(calls) == 0 {
+			continue
+		}
+		text, _ := releaseHeld(s.pending, scanGuardrails(s.pending, true), true)
+		s.pending = ""
+		choices = append(choices, chatChoice{Index: index, Delta: &responseMessage{Content: &text, ToolCalls: calls}})
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i].Index < choices[j].Index })
+	return choices
+}
+
+// text checks one piece of a plain-text answer streamed by the completion
+// endpoints, returning the text and finish reason to pass on. A nil guard
+// passes everything.
+func (g *responseGuard) text(index int, text string, finish *string) (string, *string) {
+	if g == nil {
+		return text, finish
+	}
+	choice := chatChoice{Index: index, Delta: &responseMessage{Content: &text}, FinishReason: finish}
+	g.delta(&choice)
+	return *choice.Delta.Content, choice.FinishReason
+}
+
+// complete checks a whole plain-text answer.
+func (g *responseGuard) complete(text string, finish *string) (string, *string) {
+	if g == nil {
+		return text, finish
+	}
+	choice := chatChoice{Message: &responseMessage{Content: &text}, FinishReason: finish}
+	g.message(&choice)
+	return *choice.Message.Content, choice.FinishReason
+}
+
+func filtered(choice *chatChoice, m *responseMessage) {
+	empty := ""
+	reason := "content_filter"
+	m.Content, m.ToolCalls, m.FunctionCall = &empty, nil, nil
+	choice.FinishReason = &reason
+}
@@ -0,0 +1,208 @@
+package gopilot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"4111 1111 1111 1111", true},
+		{"5500-0000-0000-0004", true},
+		{"4111111111111112", false},
+		{"79927398713", false}, // valid checksum, too short for a card
+		{"12345678901234567890", false},
+	}
+	for _, tt := range tests {
+		if got := luhn(tt.in); got != tt.want {
+			t.Errorf("luhn(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIBANChecksum(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"GB82WEST12345698765432", true},
+		{"GB82 WEST 1234 5698 7654 32", true},
+		{"DE89370400440532013000", true},
+		{"GB82WEST12345698765433", false},
+		{"GB82-WEST-1234-5698-7654-32", false},
+	}
+	for _, tt := range tests {
+		if got := ibanChecksum(tt.in); got != tt.want {
+			t.Errorf("ibanChecksum(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEntropyFilter(t *testing.T) {
+	f, err := newSecretFilter(&guardrailRule{Type: "secrets"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"random token", "key: Zx9qL2mP8vR4tN7wK1sB6yH3jD5fG0cA", true},
+		{"repeated", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa1", false},
+		{"no digits", "ThisIsAVeryLongIdentifierWithoutNumbers", false},
+		{"short", "Zx9qL2mP8vR4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := false
+			for _, m := range f.find(tt.text) {
+				if m.kind == "high_entropy" {
+					got = true
+				}
+			}
+			if got != tt.want {
+				t.Errorf("high_entropy found = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// useGuardrails installs rules for one test.
+func useGuardrails(t *testing.T, rules ...*guardrailRule) {
+	t.Helper()
+	var list []*guardrail
+	for _, rule := range rules {
+		g, err := newGuardrail(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, g)
+	}
+	old := guardrails
+	guardrails = list
+	t.Cleanup(func() { guardrails = old })
+}
+
+func TestResponseGuardHoldback(t *testing.T) {
+	useGuardrails(t,
+		&guardrailRule{Type: "pii", Action: guardRedact, Kinds: []string{"email"}},
+		&guardrailRule{Type: "terms", Action: guardBlock, Terms: []string{"Project Falcon"}},
+	)
+	long := strings.Repeat("x", 200) + " "
+	tests := []struct {
+		name     string
+		chunks   []string
+		want     string
+		filtered bool
+	}{
+		{"email split over chunks", []string{"write to car", "ol@exam", "ple.org now"}, "write to [REDACTED:email] now", false},
+		{"text before the holdback goes out", []string{long, "bob@example.com"}, long + "[REDACTED:email]", false},
+		{"blocked term split over chunks", []string{"about Proj", "ect Fal", "con and more"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newResponseGuard()
+			var out strings.Builder
+			filtered := false
+			for i, chunk := range tt.chunks {
+				text, finish := g.text(0, chunk, nil)
+				if i == 0 && len(chunk) > guardHoldback && text == "" {
+					t.Error("nothing passed on beyond the holdback")
+				}
+				if finish != nil && *finish == "content_filter" {
+					filtered = true
+				}
+				out.WriteString(text)
+			}
+			for _, held := range g.tail() {
+				out.WriteString(*held.Delta.Content)
+			}
+			if filtered != tt.filtered {
+				t.Errorf("filtered = %v, want %v", filtered, tt.filtered)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseGuardToolCalls(t *testing.T) {
+	useGuardrails(t,
+		&guardrailRule{Type: "pii", Action: guardRedact, Kinds: []string{"email"}},
+		&guardrailRule{Type: "terms", Action: guardBlock, Terms: []string{"Project Falcon"}},
+	)
+	tests := []struct {
+		name     string
+		chunks   []string
+		finish   bool // the last chunk carries a finish reason, else tail ends it
+		want     string
+		filtered bool
+	}{
+		{"email split over chunks", []string{`{"to":"car`, `ol@exam`, `ple.org"}`}, true, `{"to":"[REDACTED:email]"}`, false},
+		{"held back until the tail", []string{`{"to":"bob@`, `example.com"}`}, false, `{"to":"[REDACTED:email]"}`, false},
+		{"blocked term split over chunks", []string{`{"q":"Proj`, `ect Fal`, `con"}`}, true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newResponseGuard()
+			var args strings.Builder
+			filtered := false
+			collect := func(d *responseMessage) {
+				for _, call := range d.ToolCalls {
+					args.WriteString(call.Function.Arguments)
+				}
+			}
+			for i, chunk := range tt.chunks {
+				index := 0
+				call := responseToolCall{Index: &index, Function: responseFunction{Arguments: chunk}}
+				if i == 0 {
+					call.ID, call.Function.Name = "call_1", "send"
+				}
+				empty := ""
+				choice := chatChoice{Delta: &responseMessage{Content: &empty, ToolCalls: []responseToolCall{call}}}
+				if tt.finish && i == len(tt.chunks)-1 {
+					reason := "tool_calls"
+					choice.FinishReason = &reason
+				}
+				g.delta(&choice)
+				if choice.FinishReason != nil && *choice.FinishReason == "content_filter" {
+					filtered = true
+				}
+				collect(choice.Delta)
+			}
+			for _, held := range g.tail() {
+				collect(held.Delta)
+			}
+			if filtered != tt.filtered {
+				t.Errorf("filtered = %v, want %v", filtered, tt.filtered)
+			}
+			if got := args.String(); got != tt.want {
+				t.Errorf("arguments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("complete answer", func(t *testing.T) {
+		g := newResponseGuard()
+		choice := chatChoice{Message: &responseMessage{ToolCalls: []responseToolCall{
+			{ID: "call_1", Function: responseFunction{Name: "send", Arguments: `{"to":"carol@example.org"}`}},
+		}}}
+		g.message(&choice)
+		if got := choice.Message.ToolCalls[0].Function.Arguments; got != `{"to":"[REDACTED:email]"}` {
+			t.Errorf("arguments = %q", got)
+		}
+
+		choice = chatChoice{Message: &responseMessage{ToolCalls: []responseToolCall{
+			{ID: "call_1", Function: responseFunction{Name: "search", Arguments: `{"q":"Project Falcon"}`}},
+		}}}
+		g.message(&choice)
+		if choice.FinishReason == nil || *choice.FinishReason != "content_filter" || choice.Message.ToolCalls != nil {
+			t.Errorf("blocked tool call went out: %+v", choice.Message.ToolCalls)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+// Copy to hooks/ (or HOOKS_DIR) to load it. Scripts in pb_hooks/ run here
+// too, e.g. HOOKS_DIR=pb_hooks serves /auth from gopilot.pb.js.
+//
+// onRequest, onResponse and onResponseChunk see chat, embeddings, legacy
+// (/v1/completions) and inline (/v1/code/completions) completions, each in
+// its own endpoint's shape; check e.path before relying on one.
+
+// Cap requests per client key at 100 a minute.
+onRequest((e) => {
+  const key = e.headers["authorization"] || "anonymous";
+  if ($kv.incr(`rate:${key}`, 1, 60) > 100) {
+    return e.json(429, { error: { message: "rate limit exceeded", type: "rate_limit_error" } });
+  }
+  if (e.body.model === "gpt-4") {
+    e.body.model = "gpt-4o";
+  }
+});
+
+// Tag complete answers.
+onResponse((e) => {
+  e.body.system_fingerprint = "gopilot-hooks";
+});
+
+// Drop empty chunks from streams.
+onResponseChunk((e) => {
+  const choice = e.chunk.choices && e.chunk.choices[0];
+  if (choice && choice.delta && choice.delta.content === "" && !choice.finish_reason && !choice.delta.tool_calls) {
+    e.chunk = null;
+  }
+});
+
+routerAdd("GET", "/hooks/ping", (e) => {
+  return e.json(200, { pong: true, pings: $kv.incr("pings") });
+});
@@ -0,0 +1,761 @@
+package gopilot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+var hooksDir = GetEnvOrDefault("HOOKS_DIR", "hooks")
+
+// hooksHTTPMaxSize caps the bodies scripts read, from $http and requests
+// to their routes.
+const hooksHTTPMaxSize = 10 << 20
+
+// Hook events scripts register handlers for.
+const (
+	hookRequest       = "onRequest"
+	hookResponse      = "onResponse"
+	hookResponseChunk = "onResponseChunk"
+)
+
+// hookSet runs the scripts in HOOKS_DIR, in the style of pb_hooks. Scripts
+// register handlers with onRequest, onResponse, onResponseChunk and
+// routerAdd, and get console, $http, $kv, $template and __hooks. There is
+// no require, file or process access. The request and response handlers
+// see chat, embeddings, legacy and inline completions, each in the shape
+// its endpoint takes and answers with; e.path tells them apart.
+//
+// A goja runtime runs one handler at a time, so every script is loaded into
+// HOOKS_POOL_SIZE runtimes and each handler call takes a free one. Calls
+// running past HOOKS_TIMEOUT are interrupted, and $http only reaches public
+// hosts matching HOOKS_HTTP_ALLOW, none by default. Script routes can't
+// serve the authenticated paths, see protectedPath.
+type hookSet struct {
+	dir     string
+	timeout time.Duration
+	allow   []string
+	client  *http.Client
+	vms     chan *hookVM
+	// routes and events are the same in every runtime.
+	routes []hookRoute
+	events map[string]int
+}
+
+type hookRoute struct {
+	method string
+	path   string
+}
+
+type hookVM struct {
+	set      *hookSet
+	rt       *goja.Runtime
+	ctx      context.Context
+	handlers map[string][]goja.Callable
+	routes   []hookRoute
+	routeFns []goja.Callable
+
+	parse, stringify goja.Callable
+}
+
+// hooks is nil when HOOKS_DIR has no scripts.
+var hooks *hookSet
+
+// loadHooks loads the *.js files of dir in name order.
+func loadHooks(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.js"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		hooks = nil
+		return nil
+	}
+	timeout, err := time.ParseDuration(GetEnvOrDefault("HOOKS_TIMEOUT", "30s"))
+	if err != nil {
+		return fmt.Errorf("HOOKS_TIMEOUT: %w", err)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	programs := make([]*goja.Program, len(files))
+	for i, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if programs[i], err = goja.Compile(f, string(src), false); err != nil {
+			return err
+		}
+	}
+
+	size := max(getEnvInt("HOOKS_POOL_SIZE", 4), 1)
+	set := &hookSet{
+		dir:     abs,
+		timeout: timeout,
+		allow:   splitList(os.Getenv("HOOKS_HTTP_ALLOW")),
+		vms:     make(chan *hookVM, size),
+		events:  map[string]int{},
+	}
+	set.client = &http.Client{
+		Transport: &http.Transport{DialContext: publicDialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			if !matchHost(set.allow, req.URL.Hostname()) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+	for i := 0; i < size; i++ {
+		vm, err := set.newVM(programs)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			set.routes = vm.routes
+			for event, fns := range vm.handlers {
+				set.events[event] = len(fns)
+			}
+		}
+		set.vms <- vm
+	}
+	hooks = set
+	log.Printf("已加载 %d 个脚本：%s", len(files), dir)
+	return nil
+}
+
+func (s *hookSet) newVM(programs []*goja.Program) (*hookVM, error) {
+	rt := goja.New()
+	vm := &hookVM{set: s, rt: rt, ctx: context.Background(), handlers: map[string][]goja.Callable{}}
+	j := rt.Get("JSON").ToObject(rt)
+	vm.parse, _ = goja.AssertFunction(j.Get("parse"))
+	vm.stringify, _ = goja.AssertFunction(j.Get("stringify"))
+
+	for _, event := range []string{hookRequest, hookResponse, hookResponseChunk} {
+		event := event
+		rt.Set(event, func(fn goja.Callable) {
+			vm.handlers[event] = append(vm.handlers[event], fn)
+		})
+	}
+	rt.Set("routerAdd", func(method, path string, fn goja.Callable) {
+		if protectedPath(path) {
+			vm.throw(fmt.Errorf("routerAdd: %s is a built-in authenticated path", path))
+		}
+		vm.routes = append(vm.routes, hookRoute{method: strings.ToUpper(method), path: path})
+		vm.routeFns = append(vm.routeFns, fn)
+	})
+	rt.Set("__hooks", s.dir)
+
+	console := rt.NewObject()
+	for _, level := range []string{"log", "info", "warn", "error"} {
+		console.Set(level, func(call goja.FunctionCall) goja.Value {
+			args := make([]string, len(call.Arguments))
+			for i, a := range call.Arguments {
+				args[i] = a.String()
+			}
+			log.Println("hooks:", strings.Join(args, " "))
+			return goja.Undefined()
+		})
+	}
+	rt.Set("console", console)
+
+	httpObj := rt.NewObject()
+	httpObj.Set("send", vm.httpSend)
+	rt.Set("$http", httpObj)
+
+	kv := rt.NewObject()
+	kv.Set("get", func(key string) goja.Value {
+		data, ok := hookKV.get(key)
+		if !ok {
+			return goja.Null()
+		}
+		return vm.fromJSON(data)
+	})
+	kv.Set("set", func(key string, value, ttl goja.Value) {
+		hookKV.set(key, vm.toJSON(value), seconds(ttl))
+	})
+	kv.Set("delete", hookKV.delete)
+	kv.Set("incr", func(key string, by, ttl goja.Value) float64 {
+		n := 1.0
+		if by != nil && !goja.IsUndefined(by) && !goja.IsNull(by) {
+			n = by.ToFloat()
+		}
+		return hookKV.incr(key, n, seconds(ttl))
+	})
+	rt.Set("$kv", kv)
+
+	tmpl := rt.NewObject()
+	tmpl.Set("loadFiles", vm.loadTemplates)
+	rt.Set("$template", tmpl)
+
+	err := s.use(context.Background(), vm, func() error {
+		for _, p := range programs {
+			if _, err := rt.RunProgram(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return vm, err
+}
+
+// throw raises err in the script.
+func (vm *hookVM) throw(err error) {
+	panic(vm.rt.NewGoError(err))
+}
+
+// fromJSON turns JSON into a plain script value, null if it doesn't parse.
+func (vm *hookVM) fromJSON(data []byte) goja.Value {
+	v, err := vm.parse(goja.Undefined(), vm.rt.ToValue(string(data)))
+	if err != nil {
+		return goja.Null()
+	}
+	return v
+}
+
+// toJSON encodes a script value, undefined and functions as null.
+func (vm *hookVM) toJSON(v goja.Value) []byte {
+	if v == nil {
+		return []byte("null")
+	}
+	s, err := vm.stringify(goja.Undefined(), v)
+	if err != nil || goja.IsUndefined(s) {
+		return []byte("null")
+	}
+	return []byte(s.String())
+}
+
+// run calls fn with a free runtime.
+func (s *hookSet) run(ctx context.Context, fn func(vm *hookVM) error) error {
+	var vm *hookVM
+	select {
+	case vm = <-s.vms:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { s.vms <- vm }()
+	return s.use(ctx, vm, func() error { return fn(vm) })
+}
+
+// use runs fn on vm, interrupting the script when ctx is done or the
+// timeout passes.
+func (s *hookSet) use(ctx context.Context, vm *hookVM, fn func() error) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	vm.ctx = ctx
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		vm.rt.Interrupt(ctx.Err())
+		close(interrupted)
+	})
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("hook panic: %v", r)
+		}
+		if !stop() {
+			<-interrupted
+		}
+		vm.rt.ClearInterrupt()
+		vm.ctx = context.Background()
+	}()
+	return fn()
+}
+
+// hookReply is what a handler answered with through e.json, e.string or
+// e.html.
+type hookReply struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+func (r *hookReply) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", r.contentType)
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+}
+
+// event is the argument of a handler.
+func (vm *hookVM) event(reply *hookReply) *goja.Object {
+	e := vm.rt.NewObject()
+	e.Set("json", func(status int, v goja.Value) {
+		*reply = hookReply{status, "application/json; charset=utf-8", vm.toJSON(v)}
+	})
+	e.Set("string", func(status int, s string) {
+		*reply = hookReply{status, "text/plain; charset=utf-8", []byte(s)}
+	})
+	e.Set("html", func(status int, s string) {
+		*reply = hookReply{status, "text/html; charset=utf-8", []byte(s)}
+	})
+	return e
+}
+
+func headerObject(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k := range h {
+		m[strings.ToLower(k)] = h.Get(k)
+	}
+	return m
+}
+
+// request runs the onRequest handlers over a request body, returning the
+// body they leave, or the reply a handler answered with instead.
+func (s *hookSet) request(r *http.Request, body map[string]interface{}) (map[string]interface{}, *hookReply, error) {
+	if s == nil || s.events[hookRequest] == 0 {
+		return body, nil, nil
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers, _ := json.Marshal(headerObject(r.Header))
+	reply := &hookReply{}
+	err = s.run(r.Context(), func(vm *hookVM) error {
+		e := vm.event(reply)
+		e.Set("method", r.Method)
+		e.Set("path", r.URL.Path)
+		e.Set("headers", vm.fromJSON(headers))
+		e.Set("body", vm.fromJSON(data))
+		for _, fn := range vm.handlers[hookRequest] {
+			if _, err := fn(goja.Undefined(), e); err != nil {
+				return err
+			}
+			if reply.status != 0 {
+				return nil
+			}
+		}
+		data = vm.toJSON(e.Get("body"))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply.status != 0 {
+		return nil, reply, nil
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil || out == nil {
+		return nil, nil, errors.New("onRequest left a body that is not an object")
+	}
+	return out, nil, nil
+}
+
+// requestInto runs the onRequest handlers over a JSON request body and
+// decodes the body they leave into v. It reports false once it has
+// answered w instead.
+func (s *hookSet) requestInto(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body == nil {
+		http.Error(w, "Request body is missing or not in JSON format", http.StatusBadRequest)
+		return false
+	}
+	body, reply, err := s.request(r, body)
+	if err != nil {
+		log.Printf("onRequest 出错：%v", err)
+		http.Error(w, "request hook failed", http.StatusInternalServerError)
+		return false
+	}
+	if reply != nil {
+		reply.write(w)
+		return false
+	}
+	data, err := json.Marshal(body)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		http.Error(w, "Request body is missing or not in JSON format", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// hookCall runs the response handlers for one request.
+type hookCall struct {
+	set  *hookSet
+	path string
+}
+
+// call returns nil when no script looks at answers.
+func (s *hookSet) call(path string) *hookCall {
+	if s == nil || s.events[hookResponse]+s.events[hookResponseChunk] == 0 {
+		return nil
+	}
+	return &hookCall{set: s, path: path}
+}
+
+// response runs the onResponse handlers over a complete answer. Answers a
+// handler fails on go out unchanged.
+func (c *hookCall) response(model string, data []byte) []byte {
+	if c.set.events[hookResponse] == 0 {
+		return data
+	}
+	out, _, err := c.handle(hookResponse, "body", model, data)
+	if err != nil {
+		log.Printf("onResponse 出错：%v", err)
+		return data
+	}
+	return out
+}
+
+// chunk runs the onResponseChunk handlers over a streamed chunk, reporting
+// false when a handler set e.chunk to null to drop it.
+func (c *hookCall) chunk(model string, data []byte) ([]byte, bool) {
+	if c.set.events[hookResponseChunk] == 0 {
+		return data, true
+	}
+	out, keep, err := c.handle(hookResponseChunk, "chunk", model, data)
+	if err != nil {
+		log.Printf("onResponseChunk 出错：%v", err)
+		return data, true
+	}
+	return out, keep
+}
+
+// emit writes a chunk of a stream after the onResponseChunk handlers. c may
+// be nil.
+func (c *hookCall) emit(w http.ResponseWriter, model string, data []byte) error {
+	if c != nil {
+		var ok bool
+		if data, ok = c.chunk(model, data); !ok {
+			return nil
+		}
+	}
+	return writeEvent(w, data)
+}
+
+func (c *hookCall) handle(event, field, model string, data []byte) ([]byte, bool, error) {
+	keep := true
+	err := c.set.run(context.Background(), func(vm *hookVM) error {
+		e := vm.rt.NewObject()
+		e.Set("path", c.path)
+		e.Set("model", model)
+		e.Set(field, vm.fromJSON(data))
+		for _, fn := range vm.handlers[event] {
+			if _, err := fn(goja.Undefined(), e); err != nil {
+				return err
+			}
+		}
+		v := e.Get(field)
+		if v == nil || goja.IsNull(v) || goja.IsUndefined(v) {
+			keep = false
+			return nil
+		}
+		data = vm.toJSON(v)
+		return nil
+	})
+	return data, keep, err
+}
+
+// protectedPaths are served by the built-in handlers only, as they check
+// client keys or admin credentials that script routes don't.
+var protectedPaths = []string{"/v1/", "/openai/", "/admin/", "/dashboard"}
+
+// protectedPath reports whether p is or falls under a protected path.
+func protectedPath(p string) bool {
+	p = path.Clean("/" + p)
+	for _, prefix := range protectedPaths {
+		if strings.HasPrefix(p+"/", prefix) || strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap serves the routes scripts added ahead of next, so a script can
+// replace a public built-in route such as /auth.
+func (s *hookSet) wrap(next http.Handler) http.Handler {
+	if s == nil || len(s.routes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if protectedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for i, route := range s.routes {
+			if route.method != "*" && route.method != r.Method {
+				continue
+			}
+			if ok, _ := path.Match(route.path, r.URL.Path); ok {
+				s.serveRoute(w, r, i)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveRoute runs the handler of route i. e.requestInfo() gives the method,
+// headers, query and body of the request, the body parsed from JSON or a
+// form. A handler that doesn't answer gets 204.
+func (s *hookSet) serveRoute(w http.ResponseWriter, r *http.Request, i int) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, hooksHTTPMaxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body := map[string]interface{}{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, _ := url.ParseQuery(string(data))
+		for k := range form {
+			body[k] = form.Get(k)
+		}
+	} else if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			http.Error(w, "Request body is not a JSON object", http.StatusBadRequest)
+			return
+		}
+	}
+	query := map[string]string{}
+	for k := range r.URL.Query() {
+		query[k] = r.URL.Query().Get(k)
+	}
+	info, err := json.Marshal(map[string]interface{}{
+		"method":  r.Method,
+		"headers": headerObject(r.Header),
+		"query":   query,
+		"body":    body,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reply := &hookReply{}
+	err = s.run(r.Context(), func(vm *hookVM) error {
+		e := vm.event(reply)
+		e.Set("requestInfo", func() goja.Value { return vm.fromJSON(info) })
+		_, err := vm.routeFns[i](goja.Undefined(), e)
+		return err
+	})
+	if err != nil {
+		log.Printf("脚本路由 %s %s 出错：%v", r.Method, r.URL.Path, err)
+		http.Error(w, "hook failed", http.StatusInternalServerError)
+		return
+	}
+	if reply.status == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	reply.write(w)
+}
+
+// httpSend is $http.send({url, method, headers, body, timeout}). It returns
+// {statusCode, headers, raw, json}, json being null if the answer isn't
+// JSON. Bodies that aren't strings are sent as JSON.
+func (vm *hookVM) httpSend(call goja.FunctionCall) goja.Value {
+	opts, _ := call.Argument(0).Export().(map[string]interface{})
+	rawURL, _ := opts["url"].(string)
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		vm.throw(fmt.Errorf("$http: invalid url %q", rawURL))
+	}
+	if len(vm.set.allow) == 0 {
+		vm.throw(errors.New("$http is off, set HOOKS_HTTP_ALLOW"))
+	}
+	if !matchHost(vm.set.allow, u.Hostname()) {
+		vm.throw(fmt.Errorf("$http: %s is not allowed", u.Hostname()))
+	}
+	method, _ := opts["method"].(string)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	ctx := vm.ctx
+	if t := toFloat(opts["timeout"]); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t*float64(time.Second)))
+		defer cancel()
+	}
+	var body io.Reader
+	isJSON := false
+	switch b := opts["body"].(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			vm.throw(fmt.Errorf("$http: %w", err))
+		}
+		body, isJSON = bytes.NewReader(data), true
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), rawURL, body)
+	if err != nil {
+		vm.throw(fmt.Errorf("$http: %w", err))
+	}
+	if isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	headers, _ := opts["headers"].(map[string]interface{})
+	for k, v := range headers {
+		req.Header.Set(k, fmt.Sprint(v))
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := vm.set.client.Do(req)
+	if err != nil {
+		vm.throw(fmt.Errorf("$http: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, hooksHTTPMaxSize+1))
+	if err != nil {
+		vm.throw(fmt.Errorf("$http: %w", err))
+	}
+	if len(data) > hooksHTTPMaxSize {
+		vm.throw(fmt.Errorf("$http: answer is larger than %d bytes", hooksHTTPMaxSize))
+	}
+	respHeaders, _ := json.Marshal(headerObject(resp.Header))
+
+	res := vm.rt.NewObject()
+	res.Set("statusCode", resp.StatusCode)
+	res.Set("headers", vm.fromJSON(respHeaders))
+	res.Set("raw", string(data))
+	res.Set("json", vm.fromJSON(data))
+	return res
+}
+
+// seconds turns an optional number of seconds into a duration.
+func seconds(v goja.Value) time.Duration {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return 0
+	}
+	return time.Duration(toFloat(v.Export()) * float64(time.Second))
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// loadTemplates is $template.loadFiles(...files), returning an object
+// whose render(data) executes them as html/template. Files must be in the
+// hooks directory.
+func (vm *hookVM) loadTemplates(call goja.FunctionCall) goja.Value {
+	var files []string
+	for _, a := range call.Arguments {
+		f, err := filepath.Abs(a.String())
+		if err == nil {
+			var rel string
+			rel, err = filepath.Rel(vm.set.dir, f)
+			if err == nil && (rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+				err = errors.New("outside the hooks directory")
+			}
+		}
+		if err != nil {
+			vm.throw(fmt.Errorf("$template: %s: %w", a.String(), err))
+		}
+		files = append(files, f)
+	}
+	t, err := template.ParseFiles(files...)
+	if err != nil {
+		vm.throw(fmt.Errorf("$template: %w", err))
+	}
+	obj := vm.rt.NewObject()
+	obj.Set("render", func(data goja.Value) string {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data.Export()); err != nil {
+			vm.throw(fmt.Errorf("$template: %w", err))
+		}
+		return buf.String()
+	})
+	return obj
+}
+
+// kvStore is the key-value store scripts share through $kv, in memory.
+// Values are kept as JSON; expired ones are dropped when read or swept.
+type kvStore struct {
+	mu      sync.Mutex
+	entries map[string]kvEntry
+	sweep   time.Time
+}
+
+type kvEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+var hookKV = &kvStore{entries: map[string]kvEntry{}}
+
+func (s *kvStore) lookup(key string) (kvEntry, bool) {
+	e, ok := s.entries[key]
+	if ok && !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(s.entries, key)
+		return kvEntry{}, false
+	}
+	return e, ok
+}
+
+func (s *kvStore) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	return e.value, ok
+}
+
+func (s *kvStore) set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := kvEntry{value: value}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.entries[key] = e
+	if time.Since(s.sweep) > time.Minute {
+		s.sweep = time.Now()
+		for k := range s.entries {
+			s.lookup(k)
+		}
+	}
+}
+
+func (s *kvStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// incr adds by to a number, starting from 0 with ttl if the key isn't set,
+// and returns the sum.
+func (s *kvStore) incr(key string, by float64, ttl time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	var n float64
+	if ok {
+		json.Unmarshal(e.value, &n)
+	} else if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	n += by
+	e.value, _ = json.Marshal(n)
+	s.entries[key] = e
+	return n
+}
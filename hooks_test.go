@@ -0,0 +1,206 @@
+package gopilot
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// age moves every expiry of s back by d, as if d had passed.
+func (s *kvStore) age(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.entries {
+		if !e.expires.IsZero() {
+			e.expires = e.expires.Add(-d)
+			s.entries[k] = e
+		}
+	}
+}
+
+func TestKVTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *kvStore)
+		after time.Duration
+		want  string // "" when the key is gone
+	}{
+		{"no ttl", func(s *kvStore) { s.set("k", []byte(`1`), 0) }, time.Hour, "1"},
+		{"before ttl", func(s *kvStore) { s.set("k", []byte(`1`), time.Minute) }, time.Second, "1"},
+		{"after ttl", func(s *kvStore) { s.set("k", []byte(`1`), time.Second) }, 2 * time.Second, ""},
+		{"set resets ttl", func(s *kvStore) {
+			s.set("k", []byte(`1`), time.Second)
+			s.set("k", []byte(`2`), 0)
+		}, time.Hour, "2"},
+		{"incr keeps the first ttl", func(s *kvStore) {
+			s.incr("k", 1, time.Second)
+			s.incr("k", 1, time.Hour)
+		}, 2 * time.Second, ""},
+		{"incr within ttl", func(s *kvStore) {
+			s.incr("k", 1, time.Minute)
+			s.incr("k", 2, 0)
+		}, time.Second, "3"},
+		{"incr after expiry starts over", func(s *kvStore) {
+			s.incr("k", 5, time.Second)
+			s.age(2 * time.Second)
+			s.incr("k", 1, 0)
+		}, time.Hour, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &kvStore{entries: map[string]kvEntry{}}
+			tt.setup(s)
+			s.age(tt.after)
+			got, ok := s.get("k")
+			if !ok {
+				got = nil
+			}
+			if string(got) != tt.want {
+				t.Errorf("get = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKVTTLFromScript(t *testing.T) {
+	old := hookKV
+	hookKV = &kvStore{entries: map[string]kvEntry{}}
+	t.Cleanup(func() { hookKV = old })
+	t.Setenv("HOOKS_POOL_SIZE", "1")
+
+	dir := t.TempDir()
+	script := `$kv.set("timed", {a: 1}, 60); $kv.set("forever", "x"); $kv.incr("n", 1, 0.5)`
+	if err := os.WriteFile(filepath.Join(dir, "kv.js"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadHooks(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hooks = nil })
+
+	tests := []struct {
+		key string
+		ttl time.Duration
+	}{
+		{"timed", time.Minute},
+		{"forever", 0},
+		{"n", 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		e, ok := hookKV.entries[tt.key]
+		if !ok {
+			t.Errorf("%s not set", tt.key)
+			continue
+		}
+		if tt.ttl == 0 {
+			if !e.expires.IsZero() {
+				t.Errorf("%s expires at %v, want never", tt.key, e.expires)
+			}
+			continue
+		}
+		if left := time.Until(e.expires); left <= 0 || left > tt.ttl {
+			t.Errorf("%s expires in %v, want up to %v", tt.key, left, tt.ttl)
+		}
+	}
+}
+
+// useHooks loads script as the only hook for one test.
+func useHooks(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.js"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOOKS_POOL_SIZE", "1")
+	old := hooks
+	if err := loadHooks(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hooks = old })
+}
+
+func TestHooksOnCompletions(t *testing.T) {
+	useHooks(t, `
+onRequest((e) => {
+  if (e.body.prompt) e.body.prompt = "rewritten";
+  if (e.body.prefix) e.body.prefix = "rewritten";
+});
+onResponse((e) => { e.body.hooked = e.path; });
+onResponseChunk((e) => { e.chunk.hooked = e.path; });
+`)
+	var upstream string
+	useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(r.Body)
+		upstream = string(b)
+		reply := `{"choices":[{"index":0,"message":{"content":"out"},"finish_reason":"stop"}]}`
+		switch {
+		case r.URL.String() == codeCompletionsUrl:
+			reply = "data: {\"choices\":[{\"index\":0,\"text\":\"out\",\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"
+		case strings.Contains(upstream, `"stream":true`):
+			reply = "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"out\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(reply)), Request: r}, nil
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"completions", "/v1/completions", handleCompletions, `{"model":"gpt-4o","prompt":"hi"}`},
+		{"completions stream", "/v1/completions", handleCompletions, `{"model":"gpt-4o","prompt":"hi","stream":true}`},
+		{"code completions", "/v1/code/completions", handleGhost, `{"prefix":"hi"}`},
+		{"code completions stream", "/v1/code/completions", handleGhost, `{"prefix":"hi","stream":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = ""
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer ghu_test")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if !strings.Contains(upstream, "rewritten") || strings.Contains(upstream, `"hi`) {
+				t.Errorf("onRequest didn't change the upstream request: %s", upstream)
+			}
+			hooked := `"hooked":"` + tt.path + `"`
+			if !strings.HasSuffix(tt.name, "stream") {
+				if !strings.Contains(w.Body.String(), hooked) {
+					t.Errorf("onResponse didn't run: %s", w.Body)
+				}
+				return
+			}
+			for _, line := range bytes.Split(w.Body.Bytes(), []byte("\n")) {
+				data, ok := bytes.CutPrefix(line, []byte("data: "))
+				if ok && string(data) != "[DONE]" && !bytes.Contains(data, []byte(hooked)) {
+					t.Errorf("onResponseChunk didn't run on %s", data)
+				}
+			}
+		})
+	}
+}
+
+func TestHooksReplyOnCompletions(t *testing.T) {
+	useHooks(t, `onRequest((e) => e.json(429, { error: { message: "slow down" } }));`)
+	for _, path := range []string{"/v1/completions", "/v1/code/completions"} {
+		handler := handleCompletions
+		if path == "/v1/code/completions" {
+			handler = handleGhost
+		}
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"prompt":"hi","prefix":"hi"}`))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "slow down") {
+			t.Errorf("%s: got %d %s, want the hook's reply", path, w.Code, w.Body)
+		}
+	}
+}
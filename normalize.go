@@ -0,0 +1,454 @@
+package gopilot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chatCompletion is an OpenAI chat completion or chunk. Copilot answers are
+// decoded into it and encoded again, which drops Copilot-only fields such as
+// prompt_filter_results and content_filter_results.
+type chatCompletion struct {
+	ID                string       `json:"id"`
+	Object            string       `json:"object"`
+	Created           int64        `json:"created"`
+	Model             string       `json:"model"`
+	SystemFingerprint *string      `json:"system_fingerprint,omitempty"`
+	Choices           []chatChoice `json:"choices"`
+	Usage             *chatUsage   `json:"usage,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int              `json:"index"`
+	Message      *responseMessage `json:"message,omitempty"`
+	Delta        *responseMessage `json:"delta,omitempty"`
+	Logprobs     json.RawMessage  `json:"logprobs"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+type responseMessage struct {
+	Role         string             `json:"role,omitempty"`
+	Content      *string            `json:"content"`
+	Refusal      *string            `json:"refusal,omitempty"`
+	ToolCalls    []responseToolCall `json:"tool_calls,omitempty"`
+	FunctionCall *responseFunction  `json:"function_call,omitempty"`
+}
+
+type responseToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function responseFunction `json:"function"`
+}
+
+type responseFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+type chatUsage struct {
+	PromptTokens            int             `json:"prompt_tokens"`
+	CompletionTokens        int             `json:"completion_tokens"`
+	TotalTokens             int             `json:"total_tokens"`
+	PromptTokensDetails     json.RawMessage `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails json.RawMessage `json:"completion_tokens_details,omitempty"`
+}
+
+// chatNormalizer makes Copilot chat answers OpenAI-conformant. One is used
+// per request so every chunk of a stream shares an id and timestamp.
+type chatNormalizer struct {
+	started bool
+	id      string
+	created int64
+	model   string
+	// n is the number of choices the client asked for. Copilot sometimes
+	// splits one answer over several choices, e.g. text and tool calls.
+	n int
+
+	// includeUsage is stream_options.include_usage. Streams then end with a
+	// usage chunk, counted locally if Copilot didn't send one.
+	includeUsage bool
+	messages     []interface{}
+	usage        *chatUsage
+	answer       strings.Builder
+
+	// tools adapts tool calls, nil when the request needs no shim.
+	tools *toolShim
+	// guard runs the response guardrails, nil when there are none.
+	guard *responseGuard
+	// script runs the response hooks, nil when there are none.
+	script *hookCall
+}
+
+func newChatNormalizer(model string, body map[string]interface{}) *chatNormalizer {
+	c := &chatNormalizer{
+		id:      "chatcmpl-" + randomID(12),
+		created: time.Now().Unix(),
+		model:   model,
+		n:       1,
+	}
+	if n, ok := body["n"].(float64); ok && n > 1 {
+		c.n = int(n)
+	}
+	if opts, ok := body["stream_options"].(map[string]interface{}); ok {
+		c.includeUsage, _ = opts["include_usage"].(bool)
+	}
+	c.messages, _ = body["messages"].([]interface{})
+	return c
+}
+
+// fill sets the fields Copilot leaves out. The id, timestamp and model of
+// the first chunk are kept for the rest of the stream.
+func (c *chatNormalizer) fill(cc *chatCompletion, object string) {
+	cc.Object = object
+	if !c.started {
+		c.started = true
+		if cc.ID != "" {
+			c.id = cc.ID
+		}
+		if cc.Created != 0 {
+			c.created = cc.Created
+		}
+		if cc.Model != "" {
+			c.model = cc.Model
+		}
+	}
+	cc.ID, cc.Created, cc.Model = c.id, c.created, c.model
+	if cc.Choices == nil {
+		cc.Choices = []chatChoice{}
+	}
+}
+
+// index maps a Copilot choice index onto the ones the client asked for.
+func (c *chatNormalizer) index(i int) int {
+	if i < 0 || i >= c.n {
+		return 0
+	}
+	return i
+}
+
+// completion normalizes a non-streamed answer, merging choices that Copilot
+// returned under one index.
+func (c *chatNormalizer) completion(data []byte) ([]byte, error) {
+	var cc chatCompletion
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return nil, err
+	}
+	c.fill(&cc, "chat.completion")
+
+	merged := []chatChoice{}
+	byIndex := map[int]int{}
+	for _, choice := range cc.Choices {
+		choice.Index = c.index(choice.Index)
+		choice.Delta = nil
+		if choice.Message == nil {
+			choice.Message = &responseMessage{}
+		}
+		j, seen := byIndex[choice.Index]
+		if !seen {
+			byIndex[choice.Index] = len(merged)
+			merged = append(merged, choice)
+			continue
+		}
+		into := &merged[j]
+		if choice.Message.Content != nil {
+			content := choice.Message.Content
+			if into.Message.Content != nil {
+				s := *into.Message.Content + *choice.Message.Content
+				content = &s
+			}
+			into.Message.Content = content
+		}
+		into.Message.ToolCalls = append(into.Message.ToolCalls, choice.Message.ToolCalls...)
+		if choice.FinishReason != nil {
+			into.FinishReason = choice.FinishReason
+		}
+	}
+	for i := range merged {
+		m := merged[i].Message
+		m.Role = "assistant"
+		if c.guard != nil {
+			c.guard.message(&merged[i])
+		}
+		if c.tools != nil {
+			c.tools.message(&merged[i])
+		}
+		if m.Content == nil && len(m.ToolCalls) == 0 && m.FunctionCall == nil {
+			empty := ""
+			m.Content = &empty
+		}
+		if len(m.ToolCalls) > 0 {
+			reason := "tool_calls"
+			merged[i].FinishReason = &reason
+		}
+		for j := range m.ToolCalls {
+			m.ToolCalls[j].Index = nil
+			if m.ToolCalls[j].Type == "" {
+				m.ToolCalls[j].Type = "function"
+			}
+		}
+		nullLogprobs(&merged[i])
+		c.count(m)
+		if c.tools != nil {
+			c.tools.legacyMessage(&merged[i])
+		}
+	}
+	cc.Choices = merged
+	if cc.Usage == nil {
+		cc.Usage = c.localUsage()
+	}
+	out, err := json.Marshal(cc)
+	if err != nil || c.script == nil {
+		return out, err
+	}
+	return c.script.response(c.model, out), nil
+}
+
+// chunk normalizes one streamed chunk. It reports false for chunks that
+// carry nothing for the client, such as Copilot's leading
+// prompt_filter_results chunk.
+func (c *chatNormalizer) chunk(data []byte) ([]byte, bool, error) {
+	var cc chatCompletion
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return nil, false, err
+	}
+	if cc.Usage != nil {
+		c.usage = cc.Usage
+		cc.Usage = nil
+	}
+	if len(cc.Choices) == 0 {
+		return nil, false, nil
+	}
+	c.fill(&cc, "chat.completion.chunk")
+
+	for i := range cc.Choices {
+		choice := &cc.Choices[i]
+		choice.Index = c.index(choice.Index)
+		choice.Message = nil
+		if choice.Delta == nil {
+			choice.Delta = &responseMessage{}
+		}
+		if choice.Delta.Content == nil {
+			empty := ""
+			choice.Delta.Content = &empty
+		}
+		nullLogprobs(choice)
+		if c.guard != nil {
+			c.guard.delta(choice)
+		}
+		if c.tools != nil {
+			c.tools.delta(choice)
+		}
+		c.count(choice.Delta)
+	}
+	b, err := json.Marshal(cc)
+	return b, true, err
+}
+
+// tail is the last chunks of a stream, with what the guardrails and then
+// the tool shim held back.
+func (c *chatNormalizer) tail() ([][]byte, error) {
+	var held []chatChoice
+	if c.guard != nil {
+		held = c.guard.tail()
+		if c.tools != nil {
+			for i := range held {
+				c.tools.delta(&held[i])
+			}
+		}
+	}
+	var chunks [][]byte
+	for _, choices := range [][]chatChoice{held, c.toolsTail()} {
+		if len(choices) == 0 {
+			continue
+		}
+		cc := chatCompletion{Choices: choices}
+		c.fill(&cc, "chat.completion.chunk")
+		for i := range cc.Choices {
+			nullLogprobs(&cc.Choices[i])
+			c.count(cc.Choices[i].Delta)
+		}
+		b, err := json.Marshal(cc)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, b)
+	}
+	return chunks, nil
+}
+
+func (c *chatNormalizer) toolsTail() []chatChoice {
+	if c.tools == nil {
+		return nil
+	}
+	return c.tools.tail()
+}
+
+// count keeps the text of an answer for local usage counting.
+func (c *chatNormalizer) count(m *responseMessage) {
+	if m.Content != nil {
+		c.answer.WriteString(*m.Content)
+	}
+	for _, call := range m.ToolCalls {
+		c.answer.WriteString(call.Function.Name)
+		c.answer.WriteString(call.Function.Arguments)
+	}
+	if m.FunctionCall != nil {
+		c.answer.WriteString(m.FunctionCall.Name)
+		c.answer.WriteString(m.FunctionCall.Arguments)
+	}
+}
+
+// localUsage counts the usage of the request and the answer seen so far.
+func (c *chatNormalizer) localUsage() *chatUsage {
+	u := &chatUsage{
+		PromptTokens:     countMessageTokens(c.model, c.messages),
+		CompletionTokens: countTokens(c.model, c.answer.String()),
+	}
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// usageChunk is the final chunk of a stream with include_usage, or nil
+// when the client didn't ask for one.
+func (c *chatNormalizer) usageChunk() ([]byte, error) {
+	if !c.includeUsage {
+		return nil, nil
+	}
+	usage := c.usage
+	if usage == nil {
+		usage = c.localUsage()
+	}
+	cc := chatCompletion{Usage: usage}
+	c.fill(&cc, "chat.completion.chunk")
+	return json.Marshal(cc)
+}
+
+func nullLogprobs(choice *chatChoice) {
+	if len(choice.Logprobs) == 0 {
+		choice.Logprobs = json.RawMessage("null")
+	}
+}
+
+// relayChatStream copies a chat completion stream to the client, one
+// normalized chunk at a time.
+func relayChatStream(w http.ResponseWriter, resp *http.Response, norm *chatNormalizer) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	err := scanSSE(resp.Body, func(data []byte) error {
+		out, ok, err := norm.chunk(data)
+		if err != nil {
+			log.Printf("无法解析响应：%v, %s", err, data)
+			out, ok = data, true
+		}
+		if !ok {
+			return nil
+		}
+		return norm.emit(w, out)
+	})
+	if err != nil {
+		log.Println("Error relaying stream:", err)
+		return
+	}
+	if tail, err := norm.tail(); err != nil {
+		log.Println("Error relaying stream:", err)
+	} else {
+		for _, chunk := range tail {
+			norm.emit(w, chunk)
+		}
+	}
+	if usage, err := norm.usageChunk(); err != nil {
+		log.Println("Error counting usage:", err)
+	} else if usage != nil {
+		norm.emit(w, usage)
+	}
+	io.WriteString(w, "data: [DONE]\n\n")
+}
+
+// relayChatJSON copies a chat completion to the client, normalized.
+func relayChatJSON(w http.ResponseWriter, resp *http.Response, norm *chatNormalizer) []byte {
+	return relayJSON(w, resp, norm.completion)
+}
+
+// relayJSON copies a JSON answer through fn, or as-is if fn can't parse it.
+// It returns the normalized answer, nil if there was none.
+func relayJSON(w http.ResponseWriter, resp *http.Response, fn func([]byte) ([]byte, error)) []byte {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil
+	}
+	out, err := fn(body)
+	if err != nil {
+		log.Printf("无法解析响应：%v", err)
+		w.Write(body)
+		return nil
+	}
+	w.Write(out)
+	return out
+}
+
+// emit writes a chunk of a stream after the response hooks.
+func (c *chatNormalizer) emit(w http.ResponseWriter, data []byte) error {
+	return c.script.emit(w, c.model, data)
+}
+
+// writeEvent writes one server-sent event and flushes it to the client.
+func writeEvent(w http.ResponseWriter, data []byte) error {
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+type embeddingList struct {
+	Object string           `json:"object"`
+	Data   []embeddingEntry `json:"data"`
+	Model  string           `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+
+	// cached is how many inputs came from the embedding cache.
+	cached int
+}
+
+type embeddingEntry struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+// normalizeEmbeddings fills in the object types and model Copilot leaves out
+// of embeddings answers.
+func normalizeEmbeddings(model string) func([]byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		var list embeddingList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		list.Object = "list"
+		if list.Model == "" {
+			list.Model = model
+		}
+		if list.Data == nil {
+			list.Data = []embeddingEntry{}
+		}
+		for i := range list.Data {
+			list.Data[i].Object = "embedding"
+		}
+		if list.Usage.TotalTokens == 0 {
+			list.Usage.TotalTokens = list.Usage.PromptTokens
+		}
+		return json.Marshal(list)
+	}
+}
@@ -29,33 +29,54 @@ routerAdd("POST", "/auth/check", (e) => {
   const client_id = "Iv1.b507a08c87ecfe98";
   const grantType = "urn:ietf:params:oauth:grant-type:device_code";
 
-  let { deviceCode } = e.requestInfo().body;
+  // 这里没有服务端会话，页面上的 session 就是 device_code
+  let { session, deviceCode } = e.requestInfo().body;
+  deviceCode = session || deviceCode;
   let code = 1;
   let msg = "";
   let data = "";
   if (!deviceCode) {
-    return e.json(400, { code, msg: "device code null", data });
+    return e.json(400, { code, msg: "device code null", data, status: "error" });
   }
-  let checkUserCode = (c) => {
-    const res = $http.send({
-      url: "https://github.com/login/oauth/access_token",
-      method: "POST",
-      body:
-        `client_id=${client_id}&device_code=${deviceCode}&grant_type=${grantType}`,
-      headers: {
-        "Content-Type": "application/x-www-form-urlencoded",
-        "Accept": "application/json",
-      },
-      timeout: 30,
-    });
-    return res.json.access_token;
+  const res = $http.send({
+    url: "https://github.com/login/oauth/access_token",
+    method: "POST",
+    body:
+      `client_id=${client_id}&device_code=${deviceCode}&grant_type=${grantType}`,
+    headers: {
+      "Content-Type": "application/x-www-form-urlencoded",
+      "Accept": "application/json",
+    },
+    timeout: 30,
+  });
+  // RFC 8628 3.5
+  const statuses = {
+    authorization_pending: "pending",
+    slow_down: "slow_down",
+    expired_token: "expired",
+    access_denied: "denied",
   };
-  let token = checkUserCode(deviceCode);
-  if (!token) {
-    return e.json(200, { code, msg: "token null", data });
+  let { access_token, error, error_description, interval } = res.json;
+  if (error) {
+    let status = statuses[error] || "error";
+    msg = status == "error" ? `${error}: ${error_description}` : "";
+    return e.json(200, { code, msg, data, status, interval });
+  }
+  if (!access_token) {
+    return e.json(200, { code, msg: "token null", data, status: "error" });
   }
   code = 0;
-  return e.json(200, { code, msg: "success", data: token });
+  return e.json(200, {
+    code,
+    msg: "success",
+    data: access_token,
+    status: "success",
+    type: "ghu",
+  });
+});
+
+routerAdd("POST", "/auth/cancel", (e) => {
+  return e.json(200, { code: 0, msg: "success", data: "", status: "cancelled" });
 });
 
 routerAdd("GET", "/auth", (e) => {
@@ -77,14 +98,18 @@ routerAdd("GET", "/auth", (e) => {
     if (res.json.error) {
       return e.json(400, res.json);
     }
-    let { device_code, user_code } = res.json;
+    let { device_code, user_code, verification_uri, interval, expires_in } =
+      res.json;
     // return e.json(200, { device_code, user_code });
     const html = $template.loadFiles(
       `${__hooks}/auth.tmpl`,
     ).render({
       title: "Get Copilot Token",
       userCode: user_code,
-      deviceCode: device_code,
+      session: device_code,
+      verificationUri: verification_uri,
+      interval,
+      expiresIn: expires_in,
     });
 
     return e.html(200, html);
@@ -0,0 +1,254 @@
+package gopilot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+var routesPath = GetEnvOrDefault("ROUTES_PATH", "routes.json")
+
+// defaultFallbackOn is when a rule moves on to its next fallback model if it
+// doesn't say otherwise. Copilot answers 400 for models it doesn't serve.
+var defaultFallbackOn = []string{"400", "404", "429", "5xx"}
+
+// routeRule rewrites requests whose model matches Match, a glob such as
+// "gpt-3.5*" or "claude-*". Unlike in file paths, * and ? also match "/",
+// so "*" matches "org/model".
+//
+//	{"match": "gpt-4*", "model": "gpt-4o", "max": {"max_tokens": 4096},
+//	 "group": "paid", "fallback": ["gpt-4o-mini"]}
+type routeRule struct {
+	Match string `json:"match"`
+	// Model is the upstream model to use, the requested one if empty.
+	Model string `json:"model,omitempty"`
+	// Group limits the request to pool accounts in this group.
+	Group string `json:"group,omitempty"`
+	// Set forces parameters, e.g. {"temperature": 0}.
+	Set map[string]interface{} `json:"set,omitempty"`
+	// Max clamps numeric parameters the client sent, e.g. {"max_tokens": 4096}.
+	Max map[string]float64 `json:"max,omitempty"`
+	// Fallback lists models to try in order when the upstream answer matches
+	// FallbackOn, in the DEBUG_STATUS syntax.
+	Fallback   []string `json:"fallback,omitempty"`
+	FallbackOn []string `json:"fallback_on,omitempty"`
+	// Truncate is the context window mode, see truncateMode.
+	Truncate string `json:"truncate,omitempty"`
+}
+
+type routeTable struct {
+	mu    sync.RWMutex
+	path  string
+	rules []*routeRule
+}
+
+// routes is the routing table from ROUTES_PATH. The first matching rule
+// wins; models no rule matches go upstream untouched.
+var routes = &routeTable{}
+
+// load reads the rules file, leaving the table empty if it doesn't exist.
+func (t *routeTable) load(path string) error {
+	var rules []*routeRule
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := validateRoutes(rules); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	t.rules = rules
+	return nil
+}
+
+// reload reads the rules file again, keeping the current rules on error.
+func (t *routeTable) reload() error {
+	t.mu.RLock()
+	path := t.path
+	t.mu.RUnlock()
+	return t.load(path)
+}
+
+func validateRoutes(rules []*routeRule) error {
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return fmt.Errorf("route %d: match is required", i)
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return fmt.Errorf("route %d: match %q: %w", i, rule.Match, err)
+		}
+		if !validTruncateMode(rule.Truncate) {
+			return fmt.Errorf("route %d: invalid truncate mode %q", i, rule.Truncate)
+		}
+		for _, s := range rule.FallbackOn {
+			if !validStatusFilter(s) {
+				return fmt.Errorf("route %d: invalid fallback_on entry %q", i, s)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *routeTable) list() []*routeRule {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]*routeRule(nil), t.rules...)
+}
+
+// resolve finds the route for a requested model.
+func (t *routeTable) resolve(model string) *route {
+	for _, rule := range t.list() {
+		if !matchModel(rule.Match, model) {
+			continue
+		}
+		upstream := model
+		if rule.Model != "" {
+			upstream = rule.Model
+		}
+		return &route{rule: rule, models: append([]string{upstream}, rule.Fallback...)}
+	}
+	return &route{models: []string{model}}
+}
+
+// matchModel reports whether model matches the glob pattern, with "/"
+// treated as any other character.
+func matchModel(pattern, model string) bool {
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(model, "/", "\x00"))
+	return ok
+}
+
+// route is how one request is sent upstream: the models to try in order and
+// the rule that chose them, nil when none matched.
+type route struct {
+	rule   *routeRule
+	models []string
+}
+
+func (rt *route) group() string {
+	if rt.rule == nil {
+		return ""
+	}
+	return rt.rule.Group
+}
+
+// apply rewrites body for model, forcing and clamping parameters. An
+// empty model, as Azure deployments send, leaves the field out.
+func (rt *route) apply(body map[string]interface{}, model string) {
+	if model == "" {
+		delete(body, "model")
+	} else {
+		body["model"] = model
+	}
+	if rt.rule == nil {
+		return
+	}
+	for k, v := range rt.rule.Set {
+		body[k] = v
+	}
+	for k, max := range rt.rule.Max {
+		switch v := body[k].(type) {
+		case float64:
+			if v > max {
+				body[k] = max
+			}
+		case int:
+			if float64(v) > max {
+				body[k] = int(max)
+			}
+		}
+	}
+}
+
+// dropIncompatible removes the fallback models a chat request, checked and
+// adapted for the first model, can't be sent to as it is: those that can't
+// take its images, tools or response format, or whose prompt window is too
+// small for it.
+func (rt *route) dropIncompatible(body map[string]interface{}) {
+	models := rt.models[:1]
+	for _, model := range rt.models[1:] {
+		if reason := incompatible(model, body); reason != "" {
+			log.Printf("跳过后备模型 %s：%s", model, reason)
+			continue
+		}
+		models = append(models, model)
+	}
+	rt.models = models
+}
+
+func incompatible(model string, body map[string]interface{}) string {
+	if m, ok := catalog.lookup(model); ok {
+		if hasImages(body) && !m.Vision {
+			return "no image input"
+		}
+		if _, ok := body["tools"]; ok && m.Type == "chat" && !m.ToolCalls {
+			return "no tool calls"
+		}
+		if format, _ := body["response_format"].(map[string]interface{}); format["type"] == "json_schema" && !m.StructuredOutputs {
+			return "no structured outputs"
+		}
+	}
+	if e := checkPromptSize(model, body); e != nil {
+		return "prompt too long"
+	}
+	return ""
+}
+
+func (rt *route) fallbackOn(status int) bool {
+	if rt.rule != nil && len(rt.rule.FallbackOn) > 0 {
+		return statusMatches(rt.rule.FallbackOn, status)
+	}
+	return statusMatches(defaultFallbackOn, status)
+}
+
+// sendRouted sends body to url with each of the route's models in turn,
+// moving on while the answer is one the rule falls back on. It returns the
+// last answer and the model that produced it.
+func sendRouted(ctx context.Context, cred *credential, url string, rt *route, body map[string]interface{}) (*http.Response, string, error) {
+	headers := copilotHeaders
+	if hasImages(body) {
+		headers = visionHeaders
+	}
+	for i, model := range rt.models {
+		rt.apply(body, model)
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, model, err
+		}
+		resp, err := sendUpstreamWith(ctx, cred, url, data, headers)
+		if i == len(rt.models)-1 {
+			return resp, model, err
+		}
+
+		next := rt.models[i+1]
+		switch {
+		case err != nil:
+			if errors.As(err, &tokenError{}) || ctx.Err() != nil {
+				return nil, model, err
+			}
+			log.Printf("模型 %s 请求失败，改用 %s：%v", model, next, err)
+		case rt.fallbackOn(resp.StatusCode):
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			log.Printf("模型 %s 失败：%d, %s，改用 %s", model, resp.StatusCode, b, next)
+		default:
+			return resp, model, nil
+		}
+	}
+	return nil, "", errors.New("route has no models")
+}
@@ -0,0 +1,154 @@
+package gopilot
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentRequestsSize is how many proxied requests the dashboard remembers.
+const recentRequestsSize = 200
+
+// requestRecord describes one proxied request.
+type requestRecord struct {
+	Time     time.Time
+	Path     string
+	Model    string
+	KeyID    string
+	Account  string
+	Status   int
+	Duration time.Duration
+	Error    string
+}
+
+type usageBucket struct {
+	Requests int
+	Errors   int
+}
+
+// requestStats keeps the most recent requests and hourly per-key usage for
+// the last day. Requests without a client key are counted under "".
+type requestStats struct {
+	mu     sync.Mutex
+	recent []requestRecord
+	usage  map[string]map[int64]*usageBucket
+}
+
+var requestLog = &requestStats{usage: map[string]map[int64]*usageBucket{}}
+
+// record finishes rec with the outcome captured by sw and stores it.
+func (s *requestStats) record(rec *requestRecord, sw *statusRecorder) {
+	rec.Duration = time.Since(rec.Time)
+	rec.Status = sw.status
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	if rec.Status >= 400 {
+		rec.Error = strings.TrimSpace(sw.errBody.buf.String())
+	}
+	if m, ok := sw.ResponseWriter.(interface{ setModel(string) }); ok {
+		m.setModel(rec.Model)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recent = append(s.recent, *rec)
+	if len(s.recent) > recentRequestsSize {
+		s.recent = s.recent[len(s.recent)-recentRequestsSize:]
+	}
+
+	hour := rec.Time.Unix() / 3600
+	buckets := s.usage[rec.KeyID]
+	if buckets == nil {
+		buckets = map[int64]*usageBucket{}
+		s.usage[rec.KeyID] = buckets
+	}
+	for h := range buckets {
+		if h <= hour-24 {
+			delete(buckets, h)
+		}
+	}
+	b := buckets[hour]
+	if b == nil {
+		b = &usageBucket{}
+		buckets[hour] = b
+	}
+	b.Requests++
+	if rec.Status >= 400 {
+		b.Errors++
+	}
+}
+
+// recentRequests returns up to n requests, newest first.
+func (s *requestStats) recentRequests(n int, onlyErrors bool) []requestRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []requestRecord
+	for i := len(s.recent) - 1; i >= 0 && len(list) < n; i-- {
+		if onlyErrors && s.recent[i].Status < 400 {
+			continue
+		}
+		list = append(list, s.recent[i])
+	}
+	return list
+}
+
+// hourlyUsage returns the last 24 hours of usage for a key, oldest first.
+// An empty keyID with all set sums every key.
+func (s *requestStats) hourlyUsage(keyID string, all bool) [24]usageBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out [24]usageBucket
+	now := time.Now().Unix() / 3600
+	for id, buckets := range s.usage {
+		if !all && id != keyID {
+			continue
+		}
+		for h, b := range buckets {
+			if i := 23 - int(now-h); i >= 0 && i < 24 {
+				out[i].Requests += b.Requests
+				out[i].Errors += b.Errors
+			}
+		}
+	}
+	return out
+}
+
+// statusRecorder remembers the status written by a handler and the start of
+// any error body.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	errBody capBuffer
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, errBody: capBuffer{limit: 512}}
+}
+
+func (sw *statusRecorder) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusRecorder) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if sw.status >= 400 {
+		sw.errBody.Write(b)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusRecorder) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
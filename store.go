@@ -0,0 +1,494 @@
+package gopilot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var storePath = GetEnvOrDefault("STORE_PATH", "gopilot.json")
+
+// store holds every upstream account and client key known to this process.
+// Accounts from GHU_TOKEN live only in memory; everything added at runtime is
+// persisted to STORE_PATH, which the CLI and a running server share.
+var store = &Store{}
+
+var errNotFound = errors.New("not found")
+
+type duplicateAccountError struct {
+	account *Account
+}
+
+func (e *duplicateAccountError) Error() string {
+	return fmt.Sprintf("account already registered as %s", e.account.ID)
+}
+
+type Store struct {
+	mu   sync.RWMutex
+	path string
+	env  []*Account
+	next int
+	// modTime is the store file's time when last read or written.
+	modTime time.Time
+
+	Accounts []*Account   `json:"accounts"`
+	Keys     []*ClientKey `json:"keys"`
+}
+
+// load reads the store file, leaving the store empty if it doesn't exist yet.
+func (s *Store) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+	return s.reload()
+}
+
+// reload merges the store file into memory, keeping the in-memory accounts
+// and keys, and so their request stats, where the IDs match. Callers must
+// hold s.mu.
+func (s *Store) reload() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var disk struct {
+		Accounts []*Account   `json:"accounts"`
+		Keys     []*ClientKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &disk); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+
+	accounts := make(map[string]*Account, len(s.Accounts))
+	for _, a := range s.Accounts {
+		accounts[a.ID] = a
+	}
+	for i, d := range disk.Accounts {
+		if d.Source == "" {
+			d.Source = "store"
+		}
+		a := accounts[d.ID]
+		if a == nil {
+			continue
+		}
+		if a.Token != d.Token {
+			clearAccToken(a.Token)
+		}
+		a.Login, a.Token, a.SKU, a.Groups = d.Login, d.Token, d.SKU, d.Groups
+		a.Disabled, a.Source, a.CreatedAt = d.Disabled, d.Source, d.CreatedAt
+		disk.Accounts[i] = a
+	}
+	s.Accounts, s.Keys = disk.Accounts, disk.Keys
+	return nil
+}
+
+// refresh reloads the store if another process, such as `gopilot keys`,
+// changed the file.
+func (s *Store) refresh() error {
+	if s.path == "" {
+		return nil
+	}
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	return s.reload()
+}
+
+// watch refreshes the store every interval.
+func (s *Store) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.refresh(); err != nil {
+			log.Printf("重新加载 %s 失败：%v", s.path, err)
+		}
+	}
+}
+
+// change applies fn to the store and writes it back. The file is locked
+// and re-read first, so changes made meanwhile by another process are kept.
+// Callers must hold s.mu.
+func (s *Store) change(fn func() error) error {
+	if s.path == "" {
+		return fn()
+	}
+	unlock, err := lockFile(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// lockFile takes the lock file next to path, waiting a while if another
+// process holds it. A lock left behind by a crashed process is taken over
+// once it is stale.
+func lockFile(path string) (func(), error) {
+	lock := path + ".lock"
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > 30*time.Second {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another process", path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// save writes the store file atomically. Callers must hold s.mu.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// addEnvAccounts registers the comma separated tokens from GHU_TOKEN.
+func (s *Store) addEnvAccounts(tokens string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, token := range splitList(tokens) {
+		s.env = append(s.env, &Account{
+			ID:        fmt.Sprintf("env-%d", i+1),
+			Token:     token,
+			Source:    "env",
+			CreatedAt: time.Now(),
+		})
+	}
+}
+
+// accounts returns env accounts first, then stored ones.
+func (s *Store) accounts() []*Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.all()
+}
+
+// all is accounts without locking. Callers must hold s.mu.
+func (s *Store) all() []*Account {
+	list := make([]*Account, 0, len(s.env)+len(s.Accounts))
+	list = append(list, s.env...)
+	return append(list, s.Accounts...)
+}
+
+func (s *Store) findAccount(id string) *Account {
+	for _, a := range s.accounts() {
+		if a.ID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// pickAccount returns the enabled account with the fewest requests in flight,
+// rotating the starting point so ties are spread evenly, and its token. Only
+// accounts in every non-empty group are considered.
+func (s *Store) pickAccount(groups ...string) (*Account, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := s.all()
+	if len(list) == 0 {
+		return nil, ""
+	}
+	start := s.next
+	s.next++
+
+	var best *Account
+	for i := range list {
+		a := list[(start+i)%len(list)]
+		if a.Disabled || !a.inGroups(groups) {
+			continue
+		}
+		if best == nil || a.inFlight.Load() < best.inFlight.Load() {
+			best = a
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	return best, best.Token
+}
+
+// accountToken returns the token of a, which reload may change.
+func (s *Store) accountToken(a *Account) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return a.Token
+}
+
+func (s *Store) addAccount(a *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.change(func() error {
+		for _, existing := range s.all() {
+			if existing.Token == a.Token {
+				return &duplicateAccountError{existing}
+			}
+		}
+		if a.ID == "" {
+			a.ID = randomID(4)
+		}
+		if a.Source == "" {
+			a.Source = "store"
+		}
+		a.CreatedAt = time.Now()
+		s.Accounts = append(s.Accounts, a)
+		return nil
+	})
+}
+
+func (s *Store) removeAccount(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.env {
+		if a.ID == id {
+			return fmt.Errorf("account %s comes from GHU_TOKEN and can only be disabled", id)
+		}
+	}
+	return s.change(func() error {
+		for i, a := range s.Accounts {
+			if a.ID == id {
+				s.Accounts = append(s.Accounts[:i], s.Accounts[i+1:]...)
+				clearAccToken(a.Token)
+				return nil
+			}
+		}
+		return errNotFound
+	})
+}
+
+// setAccountDisabled toggles an account. Env accounts are only toggled in
+// memory since they have nowhere to be persisted.
+func (s *Store) setAccountDisabled(id string, disabled bool) error {
+	a := s.findAccount(id)
+	if a == nil {
+		return errNotFound
+	}
+	return s.updateAccount(a, func(a *Account) {
+		a.Disabled = disabled
+	})
+}
+
+// updateAccount applies fn to a stored account and persists the result.
+func (s *Store) updateAccount(a *Account, fn func(a *Account)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a.Source == "env" {
+		fn(a)
+		return nil
+	}
+	return s.change(func() error {
+		for _, stored := range s.Accounts {
+			if stored == a {
+				fn(a)
+				return nil
+			}
+		}
+		return errNotFound
+	})
+}
+
+func (s *Store) keys() []*ClientKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*ClientKey(nil), s.Keys...)
+}
+
+func (s *Store) hasKeys() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Keys) > 0
+}
+
+// findKey looks up a client key by its secret, also reporting whether it
+// has been disabled.
+func (s *Store) findKey(secret string) (*ClientKey, bool) {
+	if secret == "" {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.Keys {
+		if k.matches(secret) {
+			return k, k.Disabled
+		}
+	}
+	return nil, false
+}
+
+func (s *Store) addKey(name string) (*ClientKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := newClientKey(name)
+	err := s.change(func() error {
+		s.Keys = append(s.Keys, k)
+		return nil
+	})
+	return k, err
+}
+
+// ensureKey returns the key called name, limited to group, adding it if
+// there is none. It never adds the first key, as that switches the server
+// from open to keyed mode and locks out clients without one; with no keys
+// it returns nil.
+func (s *Store) ensureKey(name, group string) (*ClientKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var key *ClientKey
+	err := s.change(func() error {
+		if len(s.Keys) == 0 {
+			return nil
+		}
+		for i, k := range s.Keys {
+			if k.Name == name {
+				if k.Group != group {
+					updated := *k
+					updated.Group = group
+					s.Keys[i] = &updated
+				}
+				key = s.Keys[i]
+				return nil
+			}
+		}
+		key = newClientKey(name)
+		key.Group = group
+		s.Keys = append(s.Keys, key)
+		return nil
+	})
+	return key, err
+}
+
+func newClientKey(name string) *ClientKey {
+	return &ClientKey{
+		ID:        randomID(4),
+		Name:      name,
+		Key:       "sk-gopilot-" + randomID(16),
+		CreatedAt: time.Now(),
+	}
+}
+
+func (s *Store) removeKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.change(func() error {
+		for i, k := range s.Keys {
+			if k.ID == id {
+				s.Keys = append(s.Keys[:i], s.Keys[i+1:]...)
+				return nil
+			}
+		}
+		return errNotFound
+	})
+}
+
+func (s *Store) setKeyDisabled(id string, disabled bool) error {
+	return s.updateKey(id, func(k *ClientKey) {
+		k.Disabled = disabled
+	})
+}
+
+// updateKey applies fn to a copy of a key and persists the result. Keys
+// already handed to requests are left as they were.
+func (s *Store) updateKey(id string, fn func(k *ClientKey)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.change(func() error {
+		for i, k := range s.Keys {
+			if k.ID == id {
+				updated := *k
+				fn(&updated)
+				s.Keys[i] = &updated
+				return nil
+			}
+		}
+		return errNotFound
+	})
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// maskSecret keeps just enough of a token to tell it apart from others.
+func maskSecret(s string) string {
+	if len(s) <= 12 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:8] + "..." + s[len(s)-4:]
+}
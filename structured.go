@@ -0,0 +1,268 @@
+package gopilot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/tidwall/gjson"
+)
+
+// structuredRetries is how many times an answer that doesn't match its
+// json_schema is sent back to the model for repair. STRUCTURED_INJECT puts
+// the schema in the prompt for models that don't support json_schema.
+var structuredRetries = getEnvInt("STRUCTURED_RETRIES", 2)
+var structuredInject = os.Getenv("STRUCTURED_INJECT") != ""
+
+// structuredOutput is the json_schema response format of a chat request.
+type structuredOutput struct {
+	schema *jsonschema.Schema
+	raw    json.RawMessage
+	// strict streams are answered only once the whole answer is checked.
+	strict bool
+}
+
+// structuredFormat compiles the json_schema of a chat request, nil if it
+// asks for none.
+func structuredFormat(body map[string]interface{}) (*structuredOutput, *requestError) {
+	rf, _ := body["response_format"].(map[string]interface{})
+	if rf == nil || rf["type"] != "json_schema" {
+		return nil, nil
+	}
+	js, _ := rf["json_schema"].(map[string]interface{})
+	raw, err := json.Marshal(js["schema"])
+	if err != nil {
+		return nil, paramError("response_format.json_schema.schema", "schema must be a JSON schema object")
+	}
+	c := jsonschema.NewCompiler()
+	// The schema comes from the caller; only it and its own #/ pointers
+	// may be resolved, never files or URLs the proxy can reach.
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("loading %s is not allowed", s)
+	}
+	if err := c.AddResource("schema.json", bytes.NewReader(raw)); err != nil {
+		return nil, paramError("response_format.json_schema.schema", "invalid schema: %v", err)
+	}
+	schema, err := c.Compile("schema.json")
+	if err != nil {
+		return nil, paramError("response_format.json_schema.schema", "invalid schema: %v", err)
+	}
+	strict, _ := js["strict"].(bool)
+	return &structuredOutput{schema: schema, raw: raw, strict: strict}, nil
+}
+
+// enforced reports whether answers are checked against the schema. Streams
+// are only checked in strict mode, as they have to be held back for it.
+func (s *structuredOutput) enforced(isStream bool) bool {
+	return s != nil && (!isStream || s.strict)
+}
+
+// inject replaces response_format with instructions in the prompt when the
+// catalog says model doesn't support it.
+func (s *structuredOutput) inject(model string, body map[string]interface{}) {
+	if s == nil || !structuredInject {
+		return
+	}
+	if m, ok := catalog.lookup(model); !ok || m.StructuredOutputs {
+		return
+	}
+	delete(body, "response_format")
+	prompt := "Reply with only a JSON value, without code fences or any other text, that matches this JSON schema:\n" + string(s.raw)
+	messages, _ := body["messages"].([]interface{})
+	body["messages"] = append([]interface{}{map[string]interface{}{"role": "system", "content": prompt}}, messages...)
+}
+
+// check validates the content of every choice of a completion, returning
+// the completion with code fences taken off the JSON, the content of the
+// first choice that failed and what was wrong with it.
+func (s *structuredOutput) check(completion []byte) ([]byte, string, string) {
+	var cc chatCompletion
+	if err := json.Unmarshal(completion, &cc); err != nil {
+		return completion, "", err.Error()
+	}
+	changed := false
+	for _, choice := range cc.Choices {
+		m := choice.Message
+		if m == nil || m.Content == nil {
+			continue
+		}
+		content := stripCodeFence(*m.Content)
+		if content != *m.Content {
+			m.Content = &content
+			changed = true
+		}
+		dec := json.NewDecoder(strings.NewReader(content))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return completion, content, "the reply is not valid JSON: " + err.Error()
+		}
+		if dec.More() {
+			return completion, content, "the reply has text after the JSON value"
+		}
+		if err := s.schema.Validate(v); err != nil {
+			var ve *jsonschema.ValidationError
+			if errors.As(err, &ve) {
+				var problems []string
+				for _, e := range ve.BasicOutput().Errors {
+					if e.Error != "" && !strings.HasPrefix(e.Error, "doesn't validate with") {
+						problems = append(problems, fmt.Sprintf("%s: %s", orRoot(e.InstanceLocation), e.Error))
+					}
+				}
+				if len(problems) > 0 {
+					return completion, content, strings.Join(problems, "; ")
+				}
+			}
+			return completion, content, err.Error()
+		}
+	}
+	if changed {
+		if b, err := json.Marshal(cc); err == nil {
+			completion = b
+		}
+	}
+	return completion, "", ""
+}
+
+func orRoot(location string) string {
+	if location == "" {
+		return "/"
+	}
+	return location
+}
+
+// stripCodeFence takes JSON out of a markdown code block.
+func stripCodeFence(s string) string {
+	t := strings.TrimSpace(s)
+	if !strings.HasPrefix(t, "```") || !strings.HasSuffix(t, "```") || len(t) < 6 {
+		return s
+	}
+	t = strings.TrimSuffix(t, "```")
+	if i := strings.IndexByte(t, '\n'); i >= 0 {
+		return strings.TrimSpace(t[i+1:])
+	}
+	return s
+}
+
+// relayStructured answers a request whose answer must match its schema.
+// Answers that don't are sent back to the model with what was wrong, up to
+// STRUCTURED_RETRIES times; the X-Gopilot-Schema header says whether the
+// answer finally matched, and the usage counts every attempt. Streams get
+// the checked answer replayed. It returns the answer, if it matched, and
+// whether upstream answered at all.
+func relayStructured(ctx context.Context, w http.ResponseWriter, call *upstreamCall) ([]byte, string, bool) {
+	body := make(map[string]interface{}, len(call.body))
+	for k, v := range call.body {
+		body[k] = v
+	}
+	delete(body, "stream")
+	delete(body, "stream_options")
+	messages, _ := body["messages"].([]interface{})
+
+	var out []byte
+	var model, problem string
+	var usage chatUsage
+	attempts := 0
+	for {
+		attempts++
+		resp, m, err := sendRouted(ctx, call.cred, completionsUrl, call.rt, body)
+		if err != nil {
+			http.Error(w, err.Error(), sendErrorStatus(err))
+			return nil, m, false
+		}
+		model = m
+		if resp.StatusCode != http.StatusOK {
+			relayUpstreamError(w, resp)
+			resp.Body.Close()
+			return nil, model, false
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return nil, model, false
+		}
+		if out, err = call.normalizer(model).completion(data); err != nil {
+			log.Printf("无法解析响应：%v", err)
+			http.Error(w, "invalid answer from upstream", http.StatusBadGateway)
+			return nil, model, false
+		}
+		usage.PromptTokens += int(gjson.GetBytes(out, "usage.prompt_tokens").Int())
+		usage.CompletionTokens += int(gjson.GetBytes(out, "usage.completion_tokens").Int())
+		usage.TotalTokens += int(gjson.GetBytes(out, "usage.total_tokens").Int())
+
+		var content string
+		out, content, problem = call.schema.check(out)
+		if problem == "" || attempts > structuredRetries {
+			break
+		}
+		log.Printf("回答不符合 JSON schema，重试：%s", problem)
+		messages = append(messages[:len(messages):len(messages)],
+			map[string]interface{}{"role": "assistant", "content": content},
+			map[string]interface{}{"role": "user", "content": "That reply does not match the required JSON schema: " + problem + "\nReply again with only the corrected JSON."},
+		)
+		body["messages"] = messages
+	}
+
+	if attempts > 1 {
+		out = sumUsage(out, usage)
+	}
+
+	w.Header().Set("X-Gopilot-Model", model)
+	w.Header().Set("X-Gopilot-Schema-Attempts", strconv.Itoa(attempts))
+	if problem != "" {
+		w.Header().Set("X-Gopilot-Schema", "invalid")
+		w.Header().Set("X-Gopilot-Schema-Error", headerSafe(problem))
+	} else {
+		w.Header().Set("X-Gopilot-Schema", "valid")
+	}
+
+	if stream, _ := call.body["stream"].(bool); stream {
+		// The answer went through the guardrails, tools and hooks already.
+		if err := replayChatStream(w, out, newChatNormalizer(model, call.body)); err != nil {
+			log.Println("Error replaying stream:", err)
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(out)
+	}
+	if problem != "" {
+		return nil, model, true
+	}
+	return out, model, true
+}
+
+// sumUsage sets the token counts of a completion to those of all its
+// attempts, keeping the details of the last.
+func sumUsage(completion []byte, usage chatUsage) []byte {
+	var cc chatCompletion
+	if err := json.Unmarshal(completion, &cc); err != nil || cc.Usage == nil {
+		return completion
+	}
+	cc.Usage.PromptTokens = usage.PromptTokens
+	cc.Usage.CompletionTokens = usage.CompletionTokens
+	cc.Usage.TotalTokens = usage.TotalTokens
+	b, err := json.Marshal(cc)
+	if err != nil {
+		return completion
+	}
+	return b
+}
+
+// headerSafe shortens s to one line fit for a header.
+func headerSafe(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > 200 {
+		s = strings.ToValidUTF8(s[:200], "")
+	}
+	return s
+}
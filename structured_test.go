@@ -0,0 +1,60 @@
+package gopilot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStructuredFormatRefs(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret.json")
+	if err := os.WriteFile(secret, []byte(`{"enum":["ghu_SECRETTOKEN"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		schema map[string]interface{}
+		ok     bool
+	}{
+		{"inline", map[string]interface{}{"type": "object"}, true},
+		{"draft meta-schema", map[string]interface{}{
+			"$schema": "https://json-schema.org/draft/2020-12/schema",
+			"type":    "object",
+		}, true},
+		{"local pointer", map[string]interface{}{
+			"$defs": map[string]interface{}{"n": map[string]interface{}{"type": "number"}},
+			"$ref":  "#/$defs/n",
+		}, true},
+		{"file ref", map[string]interface{}{"$ref": "file://" + secret}, false},
+		{"http ref", map[string]interface{}{"$ref": "http://127.0.0.1:1/schema.json"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"response_format": map[string]interface{}{
+				"type":        "json_schema",
+				"json_schema": map[string]interface{}{"name": "x", "schema": tt.schema},
+			}}
+			s, e := structuredFormat(body)
+			if tt.ok {
+				if e != nil || s == nil {
+					t.Fatalf("structuredFormat = %v", e)
+				}
+				return
+			}
+			if e == nil {
+				t.Fatal("schema with an external $ref was accepted")
+			}
+			if strings.Contains(e.Message, "SECRETTOKEN") {
+				t.Errorf("error leaks the referenced file: %s", e.Message)
+			}
+			w := httptest.NewRecorder()
+			writeRequestError(w, e)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package gopilot
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type tokenizeRequest struct {
+	Model string          `json:"model"`
+	Input json.RawMessage `json:"input"`
+}
+
+type tokenizeResult struct {
+	Index  int   `json:"index"`
+	Tokens []int `json:"tokens"`
+	Count  int   `json:"count"`
+}
+
+// handleTokenize returns the token IDs of each input for a model.
+func handleTokenize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req tokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRequestError(w, paramError("", "request body must be JSON"))
+		return
+	}
+	if req.Model == "" {
+		writeRequestError(w, paramError("model", "you must provide a model parameter"))
+		return
+	}
+	var inputs []string
+	var single string
+	if json.Unmarshal(req.Input, &single) == nil {
+		inputs = []string{single}
+	} else if json.Unmarshal(req.Input, &inputs) != nil || len(inputs) == 0 {
+		writeRequestError(w, paramError("input", "input must be a string or a non-empty array of strings"))
+		return
+	}
+
+	results := make([]tokenizeResult, len(inputs))
+	var encoding string
+	for i, input := range inputs {
+		tokens, enc, ok := encodeTokens(req.Model, input)
+		if !ok {
+			http.Error(w, "tokenizer "+enc+" is not available", http.StatusServiceUnavailable)
+			return
+		}
+		encoding = enc
+		results[i] = tokenizeResult{Index: i, Tokens: tokens, Count: len(tokens)}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object":   "list",
+		"model":    req.Model,
+		"encoding": encoding,
+		"data":     results,
+	})
+}
+
+// handleCountTokens counts the prompt tokens of a chat request, or of
+// plain input. The answer says whether the count is estimated.
+func handleCountTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body == nil {
+		writeRequestError(w, paramError("", "request body must be JSON"))
+		return
+	}
+	model, _ := body["model"].(string)
+	if model == "" {
+		writeRequestError(w, paramError("model", "you must provide a model parameter"))
+		return
+	}
+
+	n := 0
+	messages, hasMessages := body["messages"].([]interface{})
+	switch input := body["input"].(type) {
+	case string:
+		n = countTokens(model, input)
+	case []interface{}:
+		for i, item := range input {
+			s, ok := item.(string)
+			if !ok {
+				writeRequestError(w, paramError("input", "input[%d] must be a string", i))
+				return
+			}
+			n += countTokens(model, s)
+		}
+	case nil:
+		if !hasMessages {
+			writeRequestError(w, paramError("messages", "either messages or input is required"))
+			return
+		}
+		// Anthropic clients send the system prompt apart from the messages.
+		if system, ok := body["system"].(string); ok && system != "" {
+			messages = append([]interface{}{map[string]interface{}{"role": "system", "content": system}}, messages...)
+		}
+		tools, _ := body["tools"].([]interface{})
+		n = countMessageTokens(model, messages) + countToolTokens(model, tools)
+	default:
+		writeRequestError(w, paramError("input", "input must be a string or an array of strings"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object":       "token_count",
+		"model":        model,
+		"encoding":     encodingFor(model),
+		"input_tokens": n,
+		"estimated":    !exactTokens(model),
+	})
+}
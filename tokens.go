@@ -0,0 +1,290 @@
+package gopilot
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// tokenizerFiles holds the BPE ranks embedded at build time. `make build`
+// fetches cl100k_base.tiktoken and o200k_base.tiktoken into tokenizer/
+// first; a plain `go build` or `go install` embeds none, see checkTokenizer.
+//
+//go:embed tokenizer
+var tokenizerFiles embed.FS
+
+// tokenizerEncodings are the encodings `make tokenizer` fetches.
+var tokenizerEncodings = []string{tiktoken.MODEL_CL100K_BASE, tiktoken.MODEL_O200K_BASE}
+
+// tokenizerDir is searched for .tiktoken files missing from the binary.
+// TOKENIZER_DOWNLOAD lets the tokenizer fetch them from OpenAI instead, and
+// TOKENIZER_ESTIMATE lets the server run on estimated counts without them.
+var tokenizerDir = GetEnvOrDefault("TOKENIZER_DIR", "")
+var tokenizerDownload = os.Getenv("TOKENIZER_DOWNLOAD") != ""
+var tokenizerEstimate = os.Getenv("TOKENIZER_ESTIMATE") != ""
+
+// checkTokenizer fails when a binary built without `make build` has no way
+// to get the BPE ranks, rather than quietly estimating token counts.
+func checkTokenizer() error {
+	if tokenizerDownload {
+		return nil
+	}
+	var missing []string
+	for _, enc := range tokenizerEncodings {
+		name := enc + ".tiktoken"
+		if _, err := fs.Stat(tokenizerFiles, "tokenizer/"+name); err == nil {
+			continue
+		}
+		if tokenizerDir != "" {
+			if _, err := os.Stat(filepath.Join(tokenizerDir, name)); err == nil {
+				continue
+			}
+		}
+		missing = append(missing, name)
+	}
+	switch {
+	case len(missing) == 0:
+		return nil
+	case tokenizerEstimate:
+		log.Printf("没有 %s，token 数为估算值", strings.Join(missing, ", "))
+		return nil
+	}
+	return fmt.Errorf("%s not embedded: build with `make build`, or set TOKENIZER_DIR, TOKENIZER_DOWNLOAD or TOKENIZER_ESTIMATE", strings.Join(missing, ", "))
+}
+
+type tokenizerLoader struct{}
+
+func (tokenizerLoader) LoadTiktokenBpe(file string) (map[string]int, error) {
+	name := path.Base(file)
+	if data, err := tokenizerFiles.ReadFile("tokenizer/" + name); err == nil {
+		return parseBpeRanks(data)
+	}
+	if tokenizerDir != "" {
+		if data, err := os.ReadFile(filepath.Join(tokenizerDir, name)); err == nil {
+			return parseBpeRanks(data)
+		}
+	}
+	if tokenizerDownload {
+		return tiktoken.NewDefaultBpeLoader().LoadTiktokenBpe(file)
+	}
+	return nil, fmt.Errorf("%s is not embedded; run `make tokenizer`, set TOKENIZER_DIR or TOKENIZER_DOWNLOAD", name)
+}
+
+// parseBpeRanks reads a .tiktoken file: one base64 token and its rank per
+// line.
+func parseBpeRanks(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid BPE line %q", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, err
+		}
+		ranks[string(b)] = n
+	}
+	return ranks, nil
+}
+
+func init() {
+	tiktoken.SetBpeLoader(tokenizerLoader{})
+}
+
+// tokenizers holds an entry per encoding. Entries load once, outside the
+// map lock, and one that failed is dropped after a while so it's retried.
+var tokenizers = struct {
+	mu      sync.Mutex
+	entries map[string]*tokenizerEntry
+}{entries: map[string]*tokenizerEntry{}}
+
+type tokenizerEntry struct {
+	once     sync.Once
+	tk       *tiktoken.Tiktoken
+	failedAt time.Time
+}
+
+// encodingFor names the BPE encoding of model, as reported by the catalog
+// or else guessed from its name.
+func encodingFor(model string) string {
+	if m, ok := catalog.lookup(model); ok && m.Tokenizer != "" {
+		return m.Tokenizer
+	}
+	if enc, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return enc
+	}
+	for _, prefix := range []string{"gpt-4-", "gpt-3.5-", "text-embedding-"} {
+		if strings.HasPrefix(model, prefix) {
+			return tiktoken.MODEL_CL100K_BASE
+		}
+	}
+	return tiktoken.MODEL_O200K_BASE
+}
+
+// tokenizerFor returns the tokenizer of model, or nil if its encoding
+// isn't available.
+func tokenizerFor(model string) (*tiktoken.Tiktoken, string) {
+	enc := encodingFor(model)
+
+	tokenizers.mu.Lock()
+	e := tokenizers.entries[enc]
+	if e == nil {
+		e = &tokenizerEntry{}
+		tokenizers.entries[enc] = e
+	}
+	tokenizers.mu.Unlock()
+
+	e.once.Do(func() {
+		tk, err := tiktoken.GetEncoding(enc)
+		if err != nil {
+			e.failedAt = time.Now()
+			return
+		}
+		e.tk = tk
+	})
+	if e.tk == nil && time.Since(e.failedAt) >= 5*time.Minute {
+		tokenizers.mu.Lock()
+		if tokenizers.entries[enc] == e {
+			delete(tokenizers.entries, enc)
+		}
+		tokenizers.mu.Unlock()
+	}
+	return e.tk, enc
+}
+
+// encodeTokens tokenizes text for model. Special tokens are treated as
+// plain text, as they are in chat messages.
+func encodeTokens(model, text string) ([]int, string, bool) {
+	tk, enc := tokenizerFor(model)
+	if tk == nil {
+		return nil, enc, false
+	}
+	return tk.EncodeOrdinary(text), enc, true
+}
+
+// countTokens counts the tokens text takes for model. Without the model's
+// encoding it estimates about four bytes of ASCII per token and one token
+// per other character.
+func countTokens(model, text string) int {
+	if tk, _ := tokenizerFor(model); tk != nil {
+		return len(tk.EncodeOrdinary(text))
+	}
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// exactTokens reports whether countTokens is exact for model rather than
+// an estimate.
+func exactTokens(model string) bool {
+	tk, _ := tokenizerFor(model)
+	return tk != nil
+}
+
+// countMessageTokens counts the prompt tokens of chat messages the way
+// OpenAI bills them: a few tokens of framing per message plus its role,
+// name and content, and three more to prime the reply.
+func countMessageTokens(model string, messages []interface{}) int {
+	total := 3
+	for _, m := range messages {
+		m, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		total += 3
+		for key, v := range m {
+			switch v := v.(type) {
+			case string:
+				total += countTokens(model, v)
+				if key == "name" {
+					total++
+				}
+			case []interface{}:
+				for _, part := range v {
+					total += partTokens(model, part)
+				}
+			case nil:
+			default:
+				b, _ := json.Marshal(v)
+				total += countTokens(model, string(b))
+			}
+		}
+	}
+	return total
+}
+
+// countToolTokens counts the tool definitions sent along with a prompt.
+func countToolTokens(model string, tools []interface{}) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	b, _ := json.Marshal(tools)
+	return countTokens(model, string(b))
+}
+
+// imageTokens is what OpenAI bills for a low detail image, used for every
+// image since their size isn't known here.
+const imageTokens = 85
+
+// partTokens counts a content part or tool call.
+func partTokens(model string, part interface{}) int {
+	p, ok := part.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	if p["type"] == "image_url" {
+		return imageTokens
+	}
+	if text, ok := p["text"].(string); ok {
+		return countTokens(model, text)
+	}
+	b, _ := json.Marshal(p)
+	return countTokens(model, string(b))
+}
+
+// checkPromptSize rejects chat requests whose prompt can't fit the model's
+// context. Only exact counts are trusted to reject a request.
+func checkPromptSize(model string, body map[string]interface{}) *requestError {
+	m, ok := catalog.lookup(model)
+	if !ok || m.MaxPromptTokens == 0 || !exactTokens(model) {
+		return nil
+	}
+	messages, _ := body["messages"].([]interface{})
+	tools, _ := body["tools"].([]interface{})
+	n := countMessageTokens(model, messages) + countToolTokens(model, tools)
+	if n <= m.MaxPromptTokens {
+		return nil
+	}
+	return &requestError{
+		Param:   "messages",
+		Code:    "context_length_exceeded",
+		Message: fmt.Sprintf("This model's maximum prompt length is %d tokens. However, your messages resulted in %d tokens.", m.MaxPromptTokens, n),
+	}
+}
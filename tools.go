@@ -0,0 +1,378 @@
+package gopilot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// toolShim adapts tool calling between clients and models. Clients that send
+// the legacy functions and function_call get answers in that format, and
+// models the catalog says can't call tools are taught to through the prompt,
+// with their calls parsed back out of the text.
+type toolShim struct {
+	legacy   bool
+	emulated bool
+	streams  map[int]*toolStream
+}
+
+// adaptTools rewrites a chat request for model, returning nil when it needs
+// no shim.
+func adaptTools(model string, body map[string]interface{}) *toolShim {
+	shim := &toolShim{}
+	if _, ok := body["functions"]; ok {
+		shim.legacy = true
+		functionsToTools(body)
+	}
+	if _, ok := body["tools"]; ok {
+		if m, ok := catalog.lookup(model); ok && m.Type == "chat" && !m.ToolCalls {
+			shim.emulated = true
+			emulateTools(body)
+		}
+	}
+	if !shim.legacy && !shim.emulated {
+		return nil
+	}
+	shim.streams = map[int]*toolStream{}
+	return shim
+}
+
+// variant tells answers shaped by the shim apart in the response cache.
+func (s *toolShim) variant() string {
+	if s == nil || !s.legacy {
+		return ""
+	}
+	return "-functions"
+}
+
+// functionsToTools turns legacy functions, function_call and function
+// messages into their tools equivalents.
+func functionsToTools(body map[string]interface{}) {
+	if functions, ok := body["functions"].([]interface{}); ok {
+		tools := make([]interface{}, len(functions))
+		for i, f := range functions {
+			tools[i] = map[string]interface{}{"type": "function", "function": f}
+		}
+		body["tools"] = tools
+	}
+	delete(body, "functions")
+
+	switch choice := body["function_call"].(type) {
+	case string:
+		body["tool_choice"] = choice
+	case map[string]interface{}:
+		body["tool_choice"] = map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choice["name"]},
+		}
+	}
+	delete(body, "function_call")
+
+	// Function results name the function, tool results the call; each
+	// answers the latest call of its function.
+	messages, _ := body["messages"].([]interface{})
+	lastCall := map[string]string{}
+	for _, m := range messages {
+		msg, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if call, ok := msg["function_call"].(map[string]interface{}); ok {
+			name, _ := call["name"].(string)
+			id := "call_" + randomID(12)
+			lastCall[name] = id
+			msg["tool_calls"] = []interface{}{map[string]interface{}{
+				"id":       id,
+				"type":     "function",
+				"function": call,
+			}}
+			delete(msg, "function_call")
+		}
+		if msg["role"] == "function" {
+			name, _ := msg["name"].(string)
+			id, ok := lastCall[name]
+			if !ok {
+				id = "call_" + randomID(12)
+			}
+			msg["role"] = "tool"
+			msg["tool_call_id"] = id
+			delete(msg, "name")
+		}
+	}
+}
+
+// emulateTools replaces tools with instructions in the system prompt, and
+// earlier tool calls and results with the text the model is told to use.
+func emulateTools(body map[string]interface{}) {
+	tools, _ := body["tools"].([]interface{})
+	choice := body["tool_choice"]
+	delete(body, "tools")
+	delete(body, "tool_choice")
+	delete(body, "parallel_tool_calls")
+
+	names := map[string]string{}
+	messages, _ := body["messages"].([]interface{})
+	for i, m := range messages {
+		msg, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch msg["role"] {
+		case "assistant":
+			calls, _ := msg["tool_calls"].([]interface{})
+			if len(calls) == 0 {
+				continue
+			}
+			var text strings.Builder
+			if content, ok := msg["content"].(string); ok {
+				text.WriteString(content)
+			}
+			for _, c := range calls {
+				call, _ := c.(map[string]interface{})
+				f, _ := call["function"].(map[string]interface{})
+				name, _ := f["name"].(string)
+				if id, ok := call["id"].(string); ok {
+					names[id] = name
+				}
+				args, _ := f["arguments"].(string)
+				if !json.Valid([]byte(args)) {
+					b, _ := json.Marshal(args)
+					args = string(b)
+				}
+				fmt.Fprintf(&text, "\n<tool_call>{\"name\": %q, \"arguments\": %s}</tool_call>", name, args)
+			}
+			messages[i] = map[string]interface{}{"role": "assistant", "content": strings.TrimSpace(text.String())}
+		case "tool":
+			id, _ := msg["tool_call_id"].(string)
+			content, ok := msg["content"].(string)
+			if !ok {
+				b, _ := json.Marshal(msg["content"])
+				content = string(b)
+			}
+			messages[i] = map[string]interface{}{
+				"role":    "user",
+				"content": fmt.Sprintf("<tool_result name=%q id=%q>\n%s\n</tool_result>", names[id], id, content),
+			}
+		}
+	}
+
+	if choice == "none" || len(tools) == 0 {
+		return
+	}
+	defs := make([]interface{}, 0, len(tools))
+	for _, t := range tools {
+		if tool, ok := t.(map[string]interface{}); ok {
+			defs = append(defs, tool["function"])
+		}
+	}
+	b, _ := json.MarshalIndent(defs, "", "  ")
+	prompt := "You can call these tools:\n<tools>\n" + string(b) + "\n</tools>\n" +
+		"To call tools, reply with one or more blocks like\n" +
+		"<tool_call>{\"name\": \"tool_name\", \"arguments\": {\"arg\": \"value\"}}</tool_call>\n" +
+		"and nothing after them. Results come back in <tool_result> blocks. Call tools only when they help; otherwise answer normally."
+	switch c := choice.(type) {
+	case string:
+		if c == "required" {
+			prompt += "\nYou must call at least one tool."
+		}
+	case map[string]interface{}:
+		f, _ := c["function"].(map[string]interface{})
+		prompt += fmt.Sprintf("\nYou must call the tool %v.", f["name"])
+	}
+	body["messages"] = append([]interface{}{map[string]interface{}{"role": "system", "content": prompt}}, messages...)
+}
+
+const toolCallOpen, toolCallClose = "<tool_call>", "</tool_call>"
+
+// parseToolCalls takes the emulated tool calls out of a model's text. Blocks
+// that don't parse are left in the text.
+func parseToolCalls(text string) (string, []responseToolCall) {
+	var calls []responseToolCall
+	var rest strings.Builder
+	for {
+		i := strings.Index(text, toolCallOpen)
+		if i < 0 {
+			rest.WriteString(text)
+			break
+		}
+		rest.WriteString(text[:i])
+		block := text[i+len(toolCallOpen):]
+		end := strings.Index(block, toolCallClose)
+		next := ""
+		if end >= 0 {
+			block, next = block[:end], block[end+len(toolCallClose):]
+		}
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if json.Unmarshal([]byte(strings.TrimSpace(block)), &call) != nil || call.Name == "" {
+			rest.WriteString(text[i : len(text)-len(next)])
+		} else {
+			args := string(call.Arguments)
+			var s string
+			if json.Unmarshal(call.Arguments, &s) == nil {
+				args = s
+			} else if len(call.Arguments) == 0 {
+				args = "{}"
+			}
+			calls = append(calls, responseToolCall{
+				ID:       "call_" + randomID(12),
+				Type:     "function",
+				Function: responseFunction{Name: call.Name, Arguments: args},
+			})
+		}
+		text = next
+	}
+	return strings.TrimSpace(rest.String()), calls
+}
+
+// toolStream holds back streamed text from the first sign of a tool call, so
+// the calls can be sent as tool_calls deltas once the stream ends.
+type toolStream struct {
+	buf    strings.Builder
+	inCall bool
+}
+
+// feed takes a text delta and returns the text that can go to the client.
+func (t *toolStream) feed(s string) string {
+	t.buf.WriteString(s)
+	if t.inCall {
+		return ""
+	}
+	text := t.buf.String()
+	if i := strings.Index(text, toolCallOpen); i >= 0 {
+		t.inCall = true
+		t.buf.Reset()
+		t.buf.WriteString(text[i:])
+		return text[:i]
+	}
+	// Keep a tail that may be the start of a tool call.
+	keep := 0
+	for n := min(len(text), len(toolCallOpen)-1); n > 0; n-- {
+		if strings.HasSuffix(text, toolCallOpen[:n]) {
+			keep = n
+			break
+		}
+	}
+	t.buf.Reset()
+	t.buf.WriteString(text[len(text)-keep:])
+	return text[:len(text)-keep]
+}
+
+// flush returns the text held back and the calls in it.
+func (t *toolStream) flush() (string, []responseToolCall) {
+	text := t.buf.String()
+	t.buf.Reset()
+	if !t.inCall {
+		return text, nil
+	}
+	t.inCall = false
+	return parseToolCalls(text)
+}
+
+// message adapts a complete answer.
+func (s *toolShim) message(choice *chatChoice) {
+	m := choice.Message
+	if s.emulated && m.Content != nil {
+		text, calls := parseToolCalls(*m.Content)
+		if len(calls) > 0 {
+			m.ToolCalls = append(m.ToolCalls, calls...)
+			m.Content = nil
+			if text != "" {
+				m.Content = &text
+			}
+		}
+	}
+}
+
+// legacyMessage turns the first tool call of a complete answer into a
+// function_call for clients that sent functions.
+func (s *toolShim) legacyMessage(choice *chatChoice) {
+	m := choice.Message
+	if !s.legacy || len(m.ToolCalls) == 0 {
+		return
+	}
+	f := m.ToolCalls[0].Function
+	m.FunctionCall = &f
+	m.ToolCalls = nil
+	reason := "function_call"
+	choice.FinishReason = &reason
+}
+
+// delta adapts one streamed choice.
+func (s *toolShim) delta(choice *chatChoice) {
+	d := choice.Delta
+	if s.emulated {
+		t := s.streams[choice.Index]
+		if t == nil {
+			t = &toolStream{}
+			s.streams[choice.Index] = t
+		}
+		if d.Content != nil {
+			text := t.feed(*d.Content)
+			d.Content = &text
+		}
+		if choice.FinishReason != nil {
+			s.flushInto(choice, t)
+		}
+	}
+	s.legacyDelta(choice)
+}
+
+// legacyDelta turns the first tool call of a streamed choice into a
+// function_call for clients that sent functions.
+func (s *toolShim) legacyDelta(choice *chatChoice) {
+	d := choice.Delta
+	if s.legacy {
+		if len(d.ToolCalls) > 0 {
+			if i := d.ToolCalls[0].Index; i == nil || *i == 0 {
+				f := d.ToolCalls[0].Function
+				d.FunctionCall = &f
+			}
+			d.ToolCalls = nil
+		}
+		if choice.FinishReason != nil && *choice.FinishReason == "tool_calls" {
+			reason := "function_call"
+			choice.FinishReason = &reason
+		}
+	}
+}
+
+// flushInto adds what a tool stream held back to the choice ending it.
+func (s *toolShim) flushInto(choice *chatChoice, t *toolStream) {
+	text, calls := t.flush()
+	d := choice.Delta
+	if d.Content != nil {
+		text = *d.Content + text
+	}
+	d.Content = &text
+	if len(calls) == 0 {
+		return
+	}
+	for i := range calls {
+		index := len(d.ToolCalls) + i
+		calls[i].Index = &index
+	}
+	d.ToolCalls = append(d.ToolCalls, calls...)
+	reason := "tool_calls"
+	choice.FinishReason = &reason
+}
+
+// tail ends the streams that never saw a finish reason, returning the
+// choices still to send in index order.
+func (s *toolShim) tail() []chatChoice {
+	var choices []chatChoice
+	for index, t := range s.streams {
+		if t.buf.Len() == 0 {
+			continue
+		}
+		choice := chatChoice{Index: index, Delta: &responseMessage{}}
+		s.flushInto(&choice, t)
+		s.legacyDelta(&choice)
+		choices = append(choices, choice)
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i].Index < choices[j].Index })
+	return choices
+}
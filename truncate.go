@@ -0,0 +1,244 @@
+package gopilot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Context window modes, chosen by the X-Gopilot-Truncate header, else the
+// route rule, else the client key.
+const (
+	truncateOff       = "off"
+	truncateMiddleOut = "middle-out"
+	truncateSummarize = "summarize"
+)
+
+func validTruncateMode(mode string) bool {
+	switch mode {
+	case "", truncateOff, truncateMiddleOut, truncateSummarize:
+		return true
+	}
+	return false
+}
+
+// truncateMode picks the context window mode of a request.
+func truncateMode(r *http.Request, rt *route, cred *credential) string {
+	if mode := r.Header.Get("X-Gopilot-Truncate"); mode != "" {
+		return mode
+	}
+	if rt.rule != nil && rt.rule.Truncate != "" {
+		return rt.rule.Truncate
+	}
+	if cred.key != nil {
+		store.mu.RLock()
+		defer store.mu.RUnlock()
+		return cred.key.Truncate
+	}
+	return ""
+}
+
+// truncation reports what fitting a prompt into the context window removed.
+type truncation struct {
+	Messages   int
+	Tokens     int
+	Summarized bool
+	Remaining  int
+}
+
+// promptBudget is how many prompt tokens model accepts for a request, or 0
+// when the catalog doesn't say.
+func promptBudget(model string, body map[string]interface{}) int {
+	m, ok := catalog.lookup(model)
+	if !ok {
+		return 0
+	}
+	budget := m.MaxPromptTokens
+	if m.MaxContextTokens > 0 {
+		reserve := m.MaxOutputTokens
+		if max, ok := body["max_tokens"].(float64); ok {
+			reserve = int(max)
+		}
+		if fit := m.MaxContextTokens - reserve; budget == 0 || fit < budget {
+			budget = fit
+		}
+	}
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
+
+// messageUnits groups messages so that an assistant message calling tools
+// stays together with the tool results answering it.
+func messageUnits(messages []interface{}) [][]interface{} {
+	var units [][]interface{}
+	for _, m := range messages {
+		role := ""
+		if mm, ok := m.(map[string]interface{}); ok {
+			role, _ = mm["role"].(string)
+		}
+		if role == "tool" && len(units) > 0 {
+			units[len(units)-1] = append(units[len(units)-1], m)
+			continue
+		}
+		units = append(units, []interface{}{m})
+	}
+	return units
+}
+
+func isSystemUnit(unit []interface{}) bool {
+	m, _ := unit[0].(map[string]interface{})
+	role, _ := m["role"].(string)
+	return role == "system" || role == "developer"
+}
+
+// fitContext trims body's messages to the model's prompt budget, middle
+// out: system messages, the first exchange that set up the task and the
+// latest message are kept, and the oldest messages in between are dropped
+// until the rest fits. In summarize mode the dropped messages are replaced
+// by a summary written by the model. It returns nil if nothing was trimmed.
+func fitContext(ctx context.Context, cred *credential, model, mode string, body map[string]interface{}) *truncation {
+	if mode != truncateMiddleOut && mode != truncateSummarize {
+		return nil
+	}
+	budget := promptBudget(model, body)
+	messages, _ := body["messages"].([]interface{})
+	if budget == 0 || len(messages) < 3 {
+		return nil
+	}
+	tools, _ := body["tools"].([]interface{})
+	budget -= countToolTokens(model, tools)
+	total := countMessageTokens(model, messages)
+	if total <= budget {
+		return nil
+	}
+
+	units := messageUnits(messages)
+	sizes := make([]int, len(units))
+	for i, unit := range units {
+		sizes[i] = countMessageTokens(model, unit) - 3
+	}
+
+	// The first non-system unit is kept, as is the last one.
+	first := -1
+	for i, unit := range units {
+		if !isSystemUnit(unit) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	drop := make([]bool, len(units))
+	t := &truncation{}
+	for i := first + 1; i < len(units)-1 && total > budget; i++ {
+		if isSystemUnit(units[i]) {
+			continue
+		}
+		drop[i] = true
+		total -= sizes[i]
+		t.Messages += len(units[i])
+		t.Tokens += sizes[i]
+	}
+	if t.Messages == 0 {
+		return nil
+	}
+
+	var kept, dropped []interface{}
+	summaryAt := -1
+	for i, unit := range units {
+		if drop[i] {
+			if summaryAt < 0 {
+				summaryAt = len(kept)
+			}
+			dropped = append(dropped, unit...)
+			continue
+		}
+		kept = append(kept, unit...)
+	}
+
+	if mode == truncateSummarize {
+		if summary, err := summarize(ctx, cred, model, dropped); err == nil {
+			note := map[string]interface{}{
+				"role":    "system",
+				"content": "Summary of the earlier conversation, which was shortened to fit the context window:\n" + summary,
+			}
+			size := countMessageTokens(model, []interface{}{note}) - 3
+			if total+size <= budget {
+				kept = append(kept[:summaryAt], append([]interface{}{note}, kept[summaryAt:]...)...)
+				total += size
+				t.Tokens -= size
+				t.Summarized = true
+			}
+		}
+	}
+
+	body["messages"] = kept
+	t.Remaining = total
+	return t
+}
+
+// summarize asks model for a summary of messages.
+func summarize(ctx context.Context, cred *credential, model string, messages []interface{}) (string, error) {
+	var transcript strings.Builder
+	for _, m := range messages {
+		mm, _ := m.(map[string]interface{})
+		role, _ := mm["role"].(string)
+		content, _ := json.Marshal(mm["content"])
+		if s, ok := mm["content"].(string); ok {
+			content = []byte(s)
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", role, content)
+		if calls, ok := mm["tool_calls"]; ok {
+			b, _ := json.Marshal(calls)
+			fmt.Fprintf(&transcript, "%s tool calls: %s\n", role, b)
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"model": model,
+		"messages": []chatMessage{
+			{Role: "system", Content: "Summarize this part of a conversation in a few short paragraphs. Keep facts, decisions, file names, tool results and open questions the rest of the conversation may depend on."},
+			{Role: "user", Content: transcript.String()},
+		},
+		"max_tokens": 1024,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := sendUpstream(ctx, cred, completionsUrl, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("summary failed: %d, %s", resp.StatusCode, data)
+	}
+	summary := gjson.GetBytes(data, "choices.0.message.content").String()
+	if summary == "" {
+		return "", fmt.Errorf("summary was empty")
+	}
+	return summary, nil
+}
+
+// setTruncationHeaders reports a truncation to the client.
+func setTruncationHeaders(w http.ResponseWriter, t *truncation) {
+	w.Header().Set("X-Gopilot-Truncated-Messages", strconv.Itoa(t.Messages))
+	w.Header().Set("X-Gopilot-Truncated-Tokens", strconv.Itoa(t.Tokens))
+	w.Header().Set("X-Gopilot-Prompt-Tokens", strconv.Itoa(t.Remaining))
+	if t.Summarized {
+		w.Header().Set("X-Gopilot-Truncated-Summary", "1")
+	}
+}
@@ -0,0 +1,118 @@
+package gopilot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCatalog installs models as the catalog for one test.
+func useCatalog(t *testing.T, models ...CatalogModel) {
+	t.Helper()
+	catalog.mu.Lock()
+	old, oldAt := catalog.models, catalog.fetchedAt
+	catalog.models, catalog.fetchedAt = models, time.Now()
+	catalog.mu.Unlock()
+	t.Cleanup(func() {
+		catalog.mu.Lock()
+		catalog.models, catalog.fetchedAt = old, oldAt
+		catalog.mu.Unlock()
+	})
+}
+
+func msg(role, content string) map[string]interface{} {
+	return map[string]interface{}{"role": role, "content": content}
+}
+
+func TestFitContextMiddleOut(t *testing.T) {
+	useCatalog(t, CatalogModel{ID: "small", Type: "chat", MaxPromptTokens: 1500})
+	big := func(tag string) string { return tag + strings.Repeat(" word", 1000) }
+	toolCall := map[string]interface{}{
+		"role":    "assistant",
+		"content": big("call"),
+		"tool_calls": []interface{}{map[string]interface{}{
+			"id": "c1", "type": "function",
+			"function": map[string]interface{}{"name": "f", "arguments": "{}"},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		messages []interface{}
+		// want is the content prefixes of the kept messages, nil when
+		// nothing is trimmed.
+		want    []string
+		dropped int
+	}{
+		{
+			name:     "off",
+			mode:     truncateOff,
+			messages: []interface{}{msg("user", big("a")), msg("assistant", big("b")), msg("user", big("c"))},
+		},
+		{
+			name:     "fits",
+			mode:     truncateMiddleOut,
+			messages: []interface{}{msg("system", "s"), msg("user", "a"), msg("user", "b")},
+		},
+		{
+			name: "oldest middle messages go first",
+			mode: truncateMiddleOut,
+			messages: []interface{}{
+				msg("system", "s"), msg("user", "first"),
+				msg("assistant", big("m1")), msg("user", big("m2")), msg("assistant", big("m3")),
+				msg("user", "last"),
+			},
+			want:    []string{"s", "first", "m3", "last"},
+			dropped: 2,
+		},
+		{
+			name: "system messages in between stay",
+			mode: truncateMiddleOut,
+			messages: []interface{}{
+				msg("user", "first"), msg("assistant", big("m1")), msg("system", "rules"),
+				msg("user", big("m2")), msg("user", "last"),
+			},
+			want:    []string{"first", "rules", "m2", "last"},
+			dropped: 1,
+		},
+		{
+			name: "tool results go with their call",
+			mode: truncateMiddleOut,
+			messages: []interface{}{
+				msg("user", "first"), toolCall, msg("tool", "result"),
+				msg("assistant", big("m2")), msg("user", "last"),
+			},
+			want:    []string{"first", "m2", "last"},
+			dropped: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"messages": tt.messages}
+			tr := fitContext(context.Background(), nil, "small", tt.mode, body)
+			if tt.want == nil {
+				if tr != nil {
+					t.Fatalf("trimmed %d messages, want none", tr.Messages)
+				}
+				return
+			}
+			if tr == nil {
+				t.Fatal("nothing trimmed")
+			}
+			if tr.Messages != tt.dropped {
+				t.Errorf("dropped %d messages, want %d", tr.Messages, tt.dropped)
+			}
+			kept, _ := body["messages"].([]interface{})
+			var got []string
+			for _, m := range kept {
+				content, _ := m.(map[string]interface{})["content"].(string)
+				got = append(got, strings.Fields(content)[0])
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
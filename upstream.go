@@ -0,0 +1,109 @@
+package gopilot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// tokenError is returned by sendUpstream when the ghu_ token could not be
+// exchanged for a Copilot token.
+type tokenError struct {
+	error
+}
+
+func (e tokenError) Unwrap() error {
+	return e.error
+}
+
+// sendUpstream posts body to a Copilot endpoint using the credential's
+// Copilot token. Non-200 answers are returned as-is for the caller to relay.
+func sendUpstream(ctx context.Context, cred *credential, url string, body []byte) (*http.Response, error) {
+	return sendUpstreamWith(ctx, cred, url, body, copilotHeaders)
+}
+
+// sendUpstreamWith is sendUpstream with the request headers built by
+// headers instead of copilotHeaders.
+func sendUpstreamWith(ctx context.Context, cred *credential, url string, body []byte, headers func(accToken string) map[string]string) (*http.Response, error) {
+	accToken, err := getAccToken(cred.token)
+	if err != nil {
+		return nil, tokenError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers(accToken) {
+		req.Header.Add(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		clearAccToken(cred.token)
+	}
+	return resp, nil
+}
+
+// sendErrorStatus is the status to answer with when sendUpstream fails.
+func sendErrorStatus(err error) int {
+	if errors.As(err, &tokenError{}) {
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+// copilotHeaders returns the headers of a fresh VS Code chat session.
+func copilotHeaders(accToken string) map[string]string {
+	sessionId := fmt.Sprintf("%s%d", uuid.New().String(), time.Now().UnixNano()/int64(time.Millisecond))
+	machineID := sha256.Sum256([]byte(uuid.New().String()))
+	machineIDStr := hex.EncodeToString(machineID[:])
+	headers := getAccHeaders(accToken, uuid.New().String(), sessionId, machineIDStr)
+	// Let net/http negotiate compression so bodies arrive decoded
+	delete(headers, "Accept-Encoding")
+	return headers
+}
+
+// poolCredential picks a pool account for work that doesn't come in over
+// HTTP, such as the CLI.
+func poolCredential() (*credential, error) {
+	account, token := store.pickAccount()
+	if account == nil {
+		return nil, errNoAccount
+	}
+	return &credential{account: account, token: token}, nil
+}
+
+// scanSSE calls fn with the payload of every "data:" line of an event
+// stream, stopping at "[DONE]".
+func scanSSE(r io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return nil
+		}
+		if err := fn([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -59,61 +59,90 @@ func models() ModelList {
 	return modelList
 }
 
+// copilotToken is the short lived Copilot token exchanged for a ghu_ token.
+type copilotToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// copilotTokens caches Copilot tokens by the ghu_ token they came from.
+var copilotTokens = cache.New(15*time.Minute, 60*time.Minute)
+
 func getAccToken(ghuToken string) (string, error) {
+	if cached, found := cachedAccToken(ghuToken); found {
+		return cached.Token, nil
+	}
+
 	var accToken = ""
 
-	cache := cache.New(15*time.Minute, 60*time.Minute)
-	cacheToken, found := cache.Get(ghuToken)
-	if found {
-		accToken = cacheToken.(string)
-	} else {
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", tokenUrl, nil)
-		if err != nil {
-			return accToken, err
-		}
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", tokenUrl, nil)
+	if err != nil {
+		return accToken, err
+	}
 
-		headers := getHeaders(ghuToken)
+	headers := getHeaders(ghuToken)
 
-		for key, value := range headers {
-			req.Header.Add(key, value)
-		}
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			return accToken, err
-		}
-		defer resp.Body.Close()
-
-		var reader interface{}
-		switch resp.Header.Get("Content-Encoding") {
-		case "gzip":
-			reader, err = gzip.NewReader(resp.Body)
-			if err != nil {
-				return accToken, fmt.Errorf("数据解压失败")
-			}
-		default:
-			reader = resp.Body
-		}
+	resp, err := client.Do(req)
+	if err != nil {
+		return accToken, err
+	}
+	defer resp.Body.Close()
 
-		body, err := io.ReadAll(reader.(io.Reader))
+	var reader interface{}
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		reader, err = gzip.NewReader(resp.Body)
 		if err != nil {
-			return accToken, fmt.Errorf("数据读取失败")
-		}
-		if resp.StatusCode == http.StatusOK {
-			accToken = gjson.GetBytes(body, "token").String()
-			if accToken == "" {
-				return accToken, fmt.Errorf("acc_token 未返回")
-			}
-			cache.Set(ghuToken, accToken, 14*time.Minute)
-		} else {
-			log.Printf("获取 acc_token 请求失败：%d, %s ", resp.StatusCode, string(body))
-			return accToken, fmt.Errorf("获取 acc_token 请求失败： %d", resp.StatusCode)
+			return accToken, fmt.Errorf("数据解压失败")
 		}
+	default:
+		reader = resp.Body
+	}
+
+	body, err := io.ReadAll(reader.(io.Reader))
+	if err != nil {
+		return accToken, fmt.Errorf("数据读取失败")
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("获取 acc_token 请求失败：%d, %s ", resp.StatusCode, string(body))
+		return accToken, fmt.Errorf("获取 acc_token 请求失败： %d", resp.StatusCode)
+	}
+
+	accToken = gjson.GetBytes(body, "token").String()
+	if accToken == "" {
+		return accToken, fmt.Errorf("acc_token 未返回")
+	}
+
+	// Refresh a minute before Copilot says the token expires, but keep it
+	// for a few seconds at least: go-cache never expires a negative ttl,
+	// which a skewed clock or short-lived token would give.
+	ttl := 14 * time.Minute
+	expiresAt := time.Now().Add(15 * time.Minute)
+	if ts := gjson.GetBytes(body, "expires_at").Int(); ts > 0 {
+		expiresAt = time.Unix(ts, 0)
+		ttl = max(time.Until(expiresAt)-time.Minute, 10*time.Second)
 	}
+	copilotTokens.Set(ghuToken, &copilotToken{Token: accToken, ExpiresAt: expiresAt}, ttl)
 	return accToken, nil
 }
 
+func cachedAccToken(ghuToken string) (*copilotToken, bool) {
+	cached, found := copilotTokens.Get(ghuToken)
+	if !found {
+		return nil, false
+	}
+	return cached.(*copilotToken), true
+}
+
+func clearAccToken(ghuToken string) {
+	copilotTokens.Delete(ghuToken)
+}
+
 func checkToken(ghuToken string) bool {
 	client := &http.Client{}
 
@@ -136,6 +165,24 @@ func checkToken(ghuToken string) bool {
 	return resp.StatusCode == http.StatusOK
 }
 
+// githubLogin returns the login of the GitHub user owning the token.
+func githubLogin(ghuToken string) (string, error) {
+	headers := map[string]string{
+		"Accept":               "application/vnd.github+json",
+		"Authorization":        "Bearer " + ghuToken,
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+	res, err := handleRequest("GET", url.Values{}, "https://api.github.com/user", headers)
+	if err != nil {
+		return "", err
+	}
+	login := gjson.Get(res, "login").String()
+	if login == "" {
+		return "", fmt.Errorf("github user lookup failed: %s", gjson.Get(res, "message").String())
+	}
+	return login, nil
+}
+
 func getHeaders(ghoToken string) map[string]string {
 	return map[string]string{
 		"Host":                  "api.github.com",
@@ -168,7 +215,17 @@ func getAccHeaders(accessToken, uuid string, sessionId string, machineId string)
 	}
 }
 
-func getDeviceCode() (string, string, error) {
+// deviceCode is GitHub's answer to a device authorization request
+// (RFC 8628 section 3.2).
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+func getDeviceCode() (*deviceCode, error) {
 	requestUrl := "https://github.com/login/device/code"
 
 	body := url.Values{}
@@ -178,18 +235,65 @@ func getDeviceCode() (string, string, error) {
 
 	body.Set("client_id", client_id)
 	res, err := handleRequest("POST", body, requestUrl, headers)
-	deviceCode := gjson.Get(res, "device_code").String()
-	userCode := gjson.Get(res, "user_code").String()
+	if err != nil {
+		return nil, err
+	}
+	if e := gjson.Get(res, "error").String(); e != "" {
+		return nil, fmt.Errorf("%s: %s", e, gjson.Get(res, "error_description").String())
+	}
 
-	if deviceCode == "" {
-		return "", "", fmt.Errorf("device code null")
+	dc := &deviceCode{
+		DeviceCode:      gjson.Get(res, "device_code").String(),
+		UserCode:        gjson.Get(res, "user_code").String(),
+		VerificationURI: gjson.Get(res, "verification_uri").String(),
+		ExpiresIn:       int(gjson.Get(res, "expires_in").Int()),
+		Interval:        int(gjson.Get(res, "interval").Int()),
+	}
+	if dc.DeviceCode == "" {
+		return nil, fmt.Errorf("device code null")
+	}
+	if dc.UserCode == "" {
+		return nil, fmt.Errorf("user code null")
+	}
+	// Defaults from RFC 8628 and GitHub's documented lifetime
+	if dc.VerificationURI == "" {
+		dc.VerificationURI = "https://github.com/login/device"
 	}
-	if userCode == "" {
-		return "", "", fmt.Errorf("user code null")
+	if dc.Interval <= 0 {
+		dc.Interval = 5
 	}
-	return deviceCode, userCode, err
+	if dc.ExpiresIn <= 0 {
+		dc.ExpiresIn = 900
+	}
+	return dc, nil
 }
 
+// Error codes the token endpoint answers with while the device flow is in
+// progress (RFC 8628 section 3.5).
+const (
+	errCodeAuthorizationPending = "authorization_pending"
+	errCodeSlowDown             = "slow_down"
+	errCodeExpiredToken         = "expired_token"
+	errCodeAccessDenied         = "access_denied"
+)
+
+// deviceFlowError is an error answer from the token endpoint. Interval is
+// set on slow_down to the new polling interval GitHub asks for.
+type deviceFlowError struct {
+	Code        string
+	Description string
+	Interval    int
+}
+
+func (e *deviceFlowError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// checkUserCode polls the token endpoint once. Until the user has approved
+// the request it returns a *deviceFlowError.
 func checkUserCode(deviceCode string) (string, error) {
 	requestUrl := "https://github.com/login/oauth/access_token"
 	body := url.Values{}
@@ -204,7 +308,17 @@ func checkUserCode(deviceCode string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if code := gjson.Get(res, "error").String(); code != "" {
+		return "", &deviceFlowError{
+			Code:        code,
+			Description: gjson.Get(res, "error_description").String(),
+			Interval:    int(gjson.Get(res, "interval").Int()),
+		}
+	}
 	token := gjson.Get(res, "access_token").String()
+	if token == "" {
+		return "", fmt.Errorf("token null")
+	}
 	return token, nil
 }
 
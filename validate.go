@@ -0,0 +1,629 @@
+package gopilot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// requestError is an invalid request, reported to the client the way OpenAI
+// does, pointing at the offending parameter.
+type requestError struct {
+	Param   string
+	Code    string
+	Message string
+}
+
+func (e *requestError) Error() string {
+	if e.Param == "" {
+		return e.Message
+	}
+	return e.Param + ": " + e.Message
+}
+
+func paramError(param, format string, args ...interface{}) *requestError {
+	return &requestError{Param: param, Message: fmt.Sprintf(format, args...)}
+}
+
+func writeRequestError(w http.ResponseWriter, e *requestError) {
+	var param, code interface{}
+	if e.Param != "" {
+		param = e.Param
+	}
+	if e.Code != "" {
+		code = e.Code
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": e.Message,
+			"type":    "invalid_request_error",
+			"param":   param,
+			"code":    code,
+		},
+	})
+}
+
+// chatCompletionRequest is the part of a chat completion request that is
+// validated. Messages and tools are decoded one by one so errors can name
+// their index.
+type chatCompletionRequest struct {
+	Model               *string           `json:"model"`
+	Messages            []json.RawMessage `json:"messages"`
+	Tools               []json.RawMessage `json:"tools"`
+	ToolChoice          json.RawMessage   `json:"tool_choice"`
+	N                   *int              `json:"n"`
+	Logprobs            *bool             `json:"logprobs"`
+	TopLogprobs         *int              `json:"top_logprobs"`
+	ResponseFormat      *responseFormat   `json:"response_format"`
+	Temperature         *float64          `json:"temperature"`
+	TopP                *float64          `json:"top_p"`
+	PresencePenalty     *float64          `json:"presence_penalty"`
+	FrequencyPenalty    *float64          `json:"frequency_penalty"`
+	MaxTokens           *int              `json:"max_tokens"`
+	MaxCompletionTokens *int              `json:"max_completion_tokens"`
+	Stop                json.RawMessage   `json:"stop"`
+	Stream              *bool             `json:"stream"`
+	StreamOptions       *struct {
+		IncludeUsage *bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+type requestMessage struct {
+	Role         string            `json:"role"`
+	Content      json.RawMessage   `json:"content"`
+	Name         *string           `json:"name"`
+	ToolCalls    []requestToolCall `json:"tool_calls"`
+	ToolCallID   *string           `json:"tool_call_id"`
+	FunctionCall json.RawMessage   `json:"function_call"`
+}
+
+type requestToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type requestContentPart struct {
+	Type     string  `json:"type"`
+	Text     *string `json:"text"`
+	ImageURL *struct {
+		URL    string `json:"url"`
+		Detail string `json:"detail"`
+	} `json:"image_url"`
+}
+
+type requestTool struct {
+	Type     string           `json:"type"`
+	Function *requestFunction `json:"function"`
+}
+
+type requestFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type responseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+		Strict *bool           `json:"strict"`
+	} `json:"json_schema"`
+}
+
+// embeddingsRequest is the part of an embeddings request that is validated.
+type embeddingsRequest struct {
+	Model          *string         `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat *string         `json:"encoding_format"`
+	Dimensions     *int            `json:"dimensions"`
+	User           *string         `json:"user"`
+}
+
+var functionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// validateChat checks a chat completion request. Azure deployments name the
+// model in the URL, so requireModel is false for them.
+func validateChat(data []byte, requireModel bool) *requestError {
+	var req chatCompletionRequest
+	if err := decodeParam(data, &req, ""); err != nil {
+		return err
+	}
+	if requireModel && (req.Model == nil || *req.Model == "") {
+		return paramError("model", "you must provide a model parameter")
+	}
+	if len(req.Messages) == 0 {
+		return paramError("messages", "messages must be a non-empty array")
+	}
+
+	toolCallIDs := map[string]bool{}
+	for i, raw := range req.Messages {
+		param := fmt.Sprintf("messages[%d]", i)
+		var m requestMessage
+		if err := decodeParam(raw, &m, param); err != nil {
+			return err
+		}
+		if err := validateMessage(&m, param, toolCallIDs); err != nil {
+			return err
+		}
+	}
+
+	tools := map[string]bool{}
+	for i, raw := range req.Tools {
+		param := fmt.Sprintf("tools[%d]", i)
+		var t requestTool
+		if err := decodeParam(raw, &t, param); err != nil {
+			return err
+		}
+		if t.Type != "function" {
+			return paramError(param+".type", "tool type must be \"function\", got %q", t.Type)
+		}
+		if t.Function == nil {
+			return paramError(param+".function", "function is required")
+		}
+		if !functionNamePattern.MatchString(t.Function.Name) {
+			return paramError(param+".function.name", "name must be 1-64 letters, digits, underscores or dashes")
+		}
+		if tools[t.Function.Name] {
+			return paramError(param+".function.name", "duplicate function name %q", t.Function.Name)
+		}
+		tools[t.Function.Name] = true
+		if err := validateSchema(t.Function.Parameters, param+".function.parameters"); err != nil {
+			return err
+		}
+	}
+	if err := validateToolChoice(req.ToolChoice, tools); err != nil {
+		return err
+	}
+
+	switch {
+	case req.N != nil && (*req.N < 1 || *req.N > 128):
+		return paramError("n", "n must be between 1 and 128")
+	case req.TopLogprobs != nil && (*req.TopLogprobs < 0 || *req.TopLogprobs > 20):
+		return paramError("top_logprobs", "top_logprobs must be between 0 and 20")
+	case req.TopLogprobs != nil && (req.Logprobs == nil || !*req.Logprobs):
+		return paramError("top_logprobs", "logprobs must be true when top_logprobs is set")
+	case req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2):
+		return paramError("temperature", "temperature must be between 0 and 2")
+	case req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1):
+		return paramError("top_p", "top_p must be between 0 and 1")
+	case req.PresencePenalty != nil && (*req.PresencePenalty < -2 || *req.PresencePenalty > 2):
+		return paramError("presence_penalty", "presence_penalty must be between -2 and 2")
+	case req.FrequencyPenalty != nil && (*req.FrequencyPenalty < -2 || *req.FrequencyPenalty > 2):
+		return paramError("frequency_penalty", "frequency_penalty must be between -2 and 2")
+	case req.MaxTokens != nil && *req.MaxTokens < 1:
+		return paramError("max_tokens", "max_tokens must be at least 1")
+	case req.MaxCompletionTokens != nil && *req.MaxCompletionTokens < 1:
+		return paramError("max_completion_tokens", "max_completion_tokens must be at least 1")
+	}
+	if req.StreamOptions != nil && (req.Stream == nil || !*req.Stream) {
+		return paramError("stream_options", "stream_options is only allowed when stream is true")
+	}
+	if err := validateStop(req.Stop); err != nil {
+		return err
+	}
+	return validateResponseFormat(req.ResponseFormat)
+}
+
+func validateMessage(m *requestMessage, param string, toolCallIDs map[string]bool) *requestError {
+	switch m.Role {
+	case "system", "developer", "user":
+		return validateContent(m.Content, param+".content", m.Role == "user")
+	case "assistant":
+		for j, call := range m.ToolCalls {
+			callParam := fmt.Sprintf("%s.tool_calls[%d]", param, j)
+			if call.ID == "" {
+				return paramError(callParam+".id", "id is required")
+			}
+			if call.Type != "function" {
+				return paramError(callParam+".type", "tool call type must be \"function\", got %q", call.Type)
+			}
+			if call.Function.Name == "" {
+				return paramError(callParam+".function.name", "name is required")
+			}
+			toolCallIDs[call.ID] = true
+		}
+		if isNull(m.Content) {
+			if len(m.ToolCalls) == 0 && isNull(m.FunctionCall) {
+				return paramError(param+".content", "content is required unless tool_calls or function_call is set")
+			}
+			return nil
+		}
+		return validateContent(m.Content, param+".content", false)
+	case "tool":
+		if m.ToolCallID == nil || *m.ToolCallID == "" {
+			return paramError(param+".tool_call_id", "tool messages must have a tool_call_id")
+		}
+		if !toolCallIDs[*m.ToolCallID] {
+			return paramError(param+".tool_call_id", "tool_call_id %q doesn't answer any earlier tool call", *m.ToolCallID)
+		}
+		return validateContent(m.Content, param+".content", false)
+	case "function":
+		if m.Name == nil || *m.Name == "" {
+			return paramError(param+".name", "function messages must have a name")
+		}
+		return nil
+	case "":
+		return paramError(param+".role", "role is required")
+	default:
+		return paramError(param+".role", "invalid role %q, expected system, developer, user, assistant or tool", m.Role)
+	}
+}
+
+// validateContent accepts a string or an array of content parts. Images are
+// only allowed in user messages.
+func validateContent(raw json.RawMessage, param string, images bool) *requestError {
+	if isNull(raw) {
+		return paramError(param, "content is required")
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return nil
+	}
+	var parts []json.RawMessage
+	if json.Unmarshal(raw, &parts) != nil {
+		return paramError(param, "content must be a string or an array of content parts")
+	}
+	for i, rawPart := range parts {
+		partParam := fmt.Sprintf("%s[%d]", param, i)
+		var part requestContentPart
+		if err := decodeParam(rawPart, &part, partParam); err != nil {
+			return err
+		}
+		switch part.Type {
+		case "text":
+			if part.Text == nil {
+				return paramError(partParam+".text", "text is required")
+			}
+		case "image_url":
+			if !images {
+				return paramError(partParam+".type", "image_url parts are only allowed in user messages")
+			}
+			if part.ImageURL == nil || part.ImageURL.URL == "" {
+				return paramError(partParam+".image_url.url", "url is required")
+			}
+		default:
+			return paramError(partParam+".type", "unsupported content part type %q", part.Type)
+		}
+	}
+	return nil
+}
+
+// validateSchema checks that a function's parameters are a JSON schema
+// describing an object.
+func validateSchema(raw json.RawMessage, param string) *requestError {
+	if isNull(raw) {
+		return nil
+	}
+	var schema map[string]interface{}
+	if json.Unmarshal(raw, &schema) != nil {
+		return paramError(param, "parameters must be a JSON schema object")
+	}
+	if t, ok := schema["type"]; ok && t != "object" {
+		return paramError(param+".type", "parameters must describe an object, got type %v", t)
+	}
+	if props, ok := schema["properties"]; ok {
+		if _, ok := props.(map[string]interface{}); !ok {
+			return paramError(param+".properties", "properties must be an object")
+		}
+	}
+	if required, ok := schema["required"]; ok {
+		list, ok := required.([]interface{})
+		if !ok {
+			return paramError(param+".required", "required must be an array of property names")
+		}
+		for _, name := range list {
+			if _, ok := name.(string); !ok {
+				return paramError(param+".required", "required must be an array of property names")
+			}
+		}
+	}
+	return nil
+}
+
+func validateToolChoice(raw json.RawMessage, tools map[string]bool) *requestError {
+	if isNull(raw) {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		switch s {
+		case "none", "auto":
+			return nil
+		case "required":
+			if len(tools) == 0 {
+				return paramError("tool_choice", "tool_choice \"required\" needs tools")
+			}
+			return nil
+		}
+		return paramError("tool_choice", "tool_choice must be none, auto, required or a function")
+	}
+	var choice struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := decodeParam(raw, &choice, "tool_choice"); err != nil {
+		return err
+	}
+	if choice.Type != "function" {
+		return paramError("tool_choice.type", "tool_choice type must be \"function\"")
+	}
+	if !tools[choice.Function.Name] {
+		return paramError("tool_choice.function.name", "no tool named %q", choice.Function.Name)
+	}
+	return nil
+}
+
+func validateStop(raw json.RawMessage) *requestError {
+	if isNull(raw) {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return nil
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) != nil {
+		return paramError("stop", "stop must be a string or an array of strings")
+	}
+	if len(list) > 4 {
+		return paramError("stop", "stop accepts at most 4 sequences")
+	}
+	return nil
+}
+
+func validateResponseFormat(f *responseFormat) *requestError {
+	if f == nil {
+		return nil
+	}
+	switch f.Type {
+	case "text", "json_object":
+		return nil
+	case "json_schema":
+		if f.JSONSchema == nil {
+			return paramError("response_format.json_schema", "json_schema is required for type json_schema")
+		}
+		if !functionNamePattern.MatchString(f.JSONSchema.Name) {
+			return paramError("response_format.json_schema.name", "name must be 1-64 letters, digits, underscores or dashes")
+		}
+		var schema map[string]interface{}
+		if json.Unmarshal(f.JSONSchema.Schema, &schema) != nil {
+			return paramError("response_format.json_schema.schema", "schema must be a JSON schema object")
+		}
+		return nil
+	default:
+		return paramError("response_format.type", "type must be text, json_object or json_schema, got %q", f.Type)
+	}
+}
+
+// validateEmbeddings checks an embeddings request.
+func validateEmbeddings(data []byte, requireModel bool) *requestError {
+	var req embeddingsRequest
+	if err := decodeParam(data, &req, ""); err != nil {
+		return err
+	}
+	if requireModel && (req.Model == nil || *req.Model == "") {
+		return paramError("model", "you must provide a model parameter")
+	}
+	if isNull(req.Input) {
+		return paramError("input", "input is required")
+	}
+
+	var s string
+	var strs []string
+	var tokens []int
+	var tokenLists [][]int
+	switch {
+	case json.Unmarshal(req.Input, &s) == nil:
+		if s == "" {
+			return paramError("input", "input must not be empty")
+		}
+	case json.Unmarshal(req.Input, &strs) == nil:
+		if len(strs) == 0 {
+			return paramError("input", "input must not be an empty array")
+		}
+		for i, s := range strs {
+			if s == "" {
+				return paramError(fmt.Sprintf("input[%d]", i), "input must not be empty")
+			}
+		}
+	case json.Unmarshal(req.Input, &tokens) == nil:
+		if len(tokens) == 0 {
+			return paramError("input", "input must not be an empty array")
+		}
+	case json.Unmarshal(req.Input, &tokenLists) == nil:
+		if len(tokenLists) == 0 {
+			return paramError("input", "input must not be an empty array")
+		}
+	default:
+		return paramError("input", "input must be a string, an array of strings, or token arrays")
+	}
+
+	if req.EncodingFormat != nil && *req.EncodingFormat != "float" && *req.EncodingFormat != "base64" {
+		return paramError("encoding_format", "encoding_format must be float or base64")
+	}
+	if req.Dimensions != nil && *req.Dimensions < 1 {
+		return paramError("dimensions", "dimensions must be at least 1")
+	}
+	return nil
+}
+
+// decodeParam unmarshals data into v, turning type mismatches into an error
+// on the parameter they happened at.
+func decodeParam(data []byte, v interface{}, param string) *requestError {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		p := param
+		if te.Field != "" {
+			p = strings.TrimPrefix(param+"."+te.Field, ".")
+		}
+		return paramError(p, "expected %s, got %s", jsonTypeName(te.Type), te.Value)
+	}
+	return paramError(param, "invalid JSON: %v", err)
+}
+
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// Request policy actions for fields Copilot rejects or handles differently.
+const (
+	policyKeep    = "keep"
+	policyStrip   = "strip"
+	policyReject  = "reject"
+	policyRewrite = "rewrite"
+)
+
+// defaultRequestPolicy says what happens to each field before a request goes
+// upstream. REQUEST_POLICY overrides entries, e.g. "seed=strip,logprobs=reject".
+var defaultRequestPolicy = map[string]string{
+	"logprobs":     policyStrip,
+	"top_logprobs": policyStrip,
+	"logit_bias":   policyStrip,
+	"service_tier": policyStrip,
+	"store":        policyStrip,
+	"metadata":     policyStrip,
+	"modalities":   policyStrip,
+	"audio":        policyStrip,
+	"prediction":   policyStrip,
+	// max_completion_tokens becomes max_tokens
+	"max_completion_tokens": policyRewrite,
+	// developer messages become system messages
+	"developer": policyRewrite,
+}
+
+// rewriters implement policyRewrite for the fields that support it.
+var rewriters = map[string]func(body map[string]interface{}){
+	"max_completion_tokens": func(body map[string]interface{}) {
+		if _, ok := body["max_tokens"]; !ok {
+			body["max_tokens"] = body["max_completion_tokens"]
+		}
+		delete(body, "max_completion_tokens")
+	},
+	"developer": func(body map[string]interface{}) {
+		messages, _ := body["messages"].([]interface{})
+		for _, m := range messages {
+			if m, ok := m.(map[string]interface{}); ok && m["role"] == "developer" {
+				m["role"] = "system"
+			}
+		}
+	},
+}
+
+var requestPolicy = defaultRequestPolicy
+
+// loadRequestPolicy merges REQUEST_POLICY into the default policy.
+func loadRequestPolicy(spec string) error {
+	policy := map[string]string{}
+	for k, v := range defaultRequestPolicy {
+		policy[k] = v
+	}
+	for _, entry := range splitList(spec) {
+		field, action, ok := strings.Cut(entry, "=")
+		field, action = strings.TrimSpace(field), strings.TrimSpace(action)
+		if !ok || field == "" {
+			return fmt.Errorf("REQUEST_POLICY: invalid entry %q, expected field=action", entry)
+		}
+		switch action {
+		case policyStrip:
+			if field == "developer" {
+				return fmt.Errorf("REQUEST_POLICY: developer messages can't be stripped")
+			}
+		case policyKeep, policyReject:
+		case policyRewrite:
+			if rewriters[field] == nil {
+				return fmt.Errorf("REQUEST_POLICY: %s can't be rewritten", field)
+			}
+		default:
+			return fmt.Errorf("REQUEST_POLICY: invalid action %q for %s", action, field)
+		}
+		policy[field] = action
+	}
+	requestPolicy = policy
+	return nil
+}
+
+// applyRequestPolicy strips, rewrites or rejects the fields of body covered
+// by the policy, returning the fields it changed. The "developer" entry
+// covers messages with that role rather than a field.
+func applyRequestPolicy(body map[string]interface{}) ([]string, *requestError) {
+	fields := make([]string, 0, len(requestPolicy))
+	for field := range requestPolicy {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var changed []string
+	for _, field := range fields {
+		present := false
+		if field == "developer" {
+			present = hasRole(body, "developer")
+		} else {
+			_, present = body[field]
+		}
+		if !present {
+			continue
+		}
+
+		switch requestPolicy[field] {
+		case policyStrip:
+			delete(body, field)
+		case policyReject:
+			return nil, paramError(field, "%s is not supported", field)
+		case policyRewrite:
+			rewriters[field](body)
+		default:
+			continue
+		}
+		changed = append(changed, field)
+	}
+	return changed, nil
+}
+
+func hasRole(body map[string]interface{}, role string) bool {
+	messages, _ := body["messages"].([]interface{})
+	for _, m := range messages {
+		if m, ok := m.(map[string]interface{}); ok && m["role"] == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package gopilot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageConfig limits the images sent along with chat messages. Remote
+// images are fetched by the proxy only from hosts matching
+// IMAGE_FETCH_ALLOW, which is empty by default so only data: URIs are
+// taken, and everything goes upstream as a data: URI no larger than
+// IMAGE_MAX_SIZE or IMAGE_MAX_DIMENSION pixels a side. Images declaring
+// more than IMAGE_MAX_PIXELS pixels are refused before they are decoded.
+type imageConfig struct {
+	allow        []string
+	maxFetch     int64
+	maxSize      int64
+	maxDimension int
+	maxPixels    int64
+}
+
+var images = &imageConfig{
+	maxFetch:     20 << 20,
+	maxSize:      4 << 20,
+	maxDimension: 2048,
+	maxPixels:    50_000_000,
+}
+
+func loadImageConfig() error {
+	c := &imageConfig{allow: splitList(os.Getenv("IMAGE_FETCH_ALLOW"))}
+	var err error
+	if c.maxFetch, err = parseSize(GetEnvOrDefault("IMAGE_MAX_FETCH_SIZE", "20MB")); err != nil {
+		return fmt.Errorf("IMAGE_MAX_FETCH_SIZE: %w", err)
+	}
+	if c.maxSize, err = parseSize(GetEnvOrDefault("IMAGE_MAX_SIZE", "4MB")); err != nil {
+		return fmt.Errorf("IMAGE_MAX_SIZE: %w", err)
+	}
+	if c.maxDimension, err = strconv.Atoi(GetEnvOrDefault("IMAGE_MAX_DIMENSION", "2048")); err != nil || c.maxDimension < 1 {
+		return fmt.Errorf("IMAGE_MAX_DIMENSION: invalid value %q", os.Getenv("IMAGE_MAX_DIMENSION"))
+	}
+	if c.maxPixels, err = strconv.ParseInt(GetEnvOrDefault("IMAGE_MAX_PIXELS", "50000000"), 10, 64); err != nil || c.maxPixels < 1 {
+		return fmt.Errorf("IMAGE_MAX_PIXELS: invalid value %q", os.Getenv("IMAGE_MAX_PIXELS"))
+	}
+	for _, pattern := range c.allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("IMAGE_FETCH_ALLOW: %q: %w", pattern, err)
+		}
+	}
+	images = c
+	return nil
+}
+
+// prepareImages checks the image parts of a chat request and replaces them
+// with data: URIs Copilot accepts.
+func prepareImages(ctx context.Context, model string, body map[string]interface{}) *requestError {
+	messages, _ := body["messages"].([]interface{})
+	for i, m := range messages {
+		msg, _ := m.(map[string]interface{})
+		parts, _ := msg["content"].([]interface{})
+		for j, p := range parts {
+			part, _ := p.(map[string]interface{})
+			if part["type"] != "image_url" {
+				continue
+			}
+			param := fmt.Sprintf("messages[%d].content[%d].image_url", i, j)
+			if cm, ok := catalog.lookup(model); ok && !cm.Vision {
+				return &requestError{
+					Param:   param,
+					Code:    "model_not_vision_capable",
+					Message: fmt.Sprintf("The model %s does not support image inputs.", model),
+				}
+			}
+			imageURL, _ := part["image_url"].(map[string]interface{})
+			u, _ := imageURL["url"].(string)
+			data, err := loadImage(ctx, u)
+			if err != nil {
+				return paramError(param+".url", "%v", err)
+			}
+			data, mime, err := fitImage(data)
+			if err != nil {
+				return paramError(param+".url", "%v", err)
+			}
+			imageURL["url"] = "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+	}
+	return nil
+}
+
+// hasImages reports whether a chat request has image parts.
+func hasImages(body map[string]interface{}) bool {
+	messages, _ := body["messages"].([]interface{})
+	for _, m := range messages {
+		msg, _ := m.(map[string]interface{})
+		parts, _ := msg["content"].([]interface{})
+		for _, p := range parts {
+			if part, _ := p.(map[string]interface{}); part["type"] == "image_url" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// visionHeaders are copilotHeaders for requests with images.
+func visionHeaders(accToken string) map[string]string {
+	headers := copilotHeaders(accToken)
+	headers["Copilot-Vision-Request"] = "true"
+	return headers
+}
+
+// loadImage returns the bytes of an image given as a data: URI or fetched
+// from an allowed http(s) URL.
+func loadImage(ctx context.Context, raw string) ([]byte, error) {
+	if strings.HasPrefix(raw, "data:") {
+		meta, payload, ok := strings.Cut(strings.TrimPrefix(raw, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, errors.New("data: URI images must be base64 encoded")
+		}
+		if int64(base64.StdEncoding.DecodedLen(len(payload))) > images.maxFetch+3 {
+			return nil, fmt.Errorf("image is larger than %d bytes", images.maxFetch)
+		}
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 image: %v", err)
+		}
+		return data, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, errors.New("image url must be an http(s) URL or a data: URI")
+	}
+	if len(images.allow) == 0 {
+		return nil, errors.New("fetching remote images is off, send the image as a data: URI")
+	}
+	if !images.allowed(u.Hostname()) {
+		return nil, fmt.Errorf("fetching images from %s is not allowed", u.Hostname())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch image: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, images.maxFetch+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch image: %v", err)
+	}
+	if int64(len(data)) > images.maxFetch {
+		return nil, fmt.Errorf("image is larger than %d bytes", images.maxFetch)
+	}
+	return data, nil
+}
+
+func (c *imageConfig) allowed(host string) bool {
+	return matchHost(c.allow, host)
+}
+
+// matchHost reports whether host matches one of the glob patterns.
+func matchHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// publicDialer won't connect to private, loopback or link-local addresses.
+// Clients using it must ignore HTTP(S)_PROXY, as the check would then apply
+// to the proxy rather than the target host.
+var publicDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			return fmt.Errorf("address %s is not public", host)
+		}
+		return nil
+	},
+}
+
+// imageClient fetches images from public addresses, checking redirects
+// against the allowlist.
+var imageClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext: publicDialer.DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("too many redirects")
+		}
+		if !images.allowed(req.URL.Hostname()) {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// fitImage checks that data is an image Copilot takes and scales or
+// re-encodes it to fit the size limits, returning the bytes to send and
+// their type.
+func fitImage(data []byte) ([]byte, string, error) {
+	mime := http.DetectContentType(data)
+	switch mime {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+	default:
+		return nil, "", fmt.Errorf("unsupported image type %s, want png, jpeg, gif or webp", mime)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %v", err)
+	}
+	if cfg.Width <= images.maxDimension && cfg.Height <= images.maxDimension && int64(len(data)) <= images.maxSize {
+		return data, mime, nil
+	}
+	// The header can claim any size; don't decode more than the budget.
+	if int64(cfg.Width)*int64(cfg.Height) > images.maxPixels {
+		return nil, "", fmt.Errorf("image is %dx%d, over the limit of %d pixels", cfg.Width, cfg.Height, images.maxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %v", err)
+	}
+	// Keep transparency as PNG; anything else becomes JPEG, which is
+	// smaller for photos.
+	opaque := true
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		opaque = o.Opaque()
+	}
+	scale := 1.0
+	if longest := max(cfg.Width, cfg.Height); longest > images.maxDimension {
+		scale = float64(images.maxDimension) / float64(longest)
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		out, mime, err := encodeImage(scaleImage(img, scale), opaque)
+		if err != nil {
+			return nil, "", err
+		}
+		if int64(len(out)) <= images.maxSize {
+			return out, mime, nil
+		}
+		scale *= 0.75
+	}
+	return nil, "", fmt.Errorf("image could not be made smaller than %d bytes", images.maxSize)
+}
+
+func scaleImage(img image.Image, scale float64) image.Image {
+	if scale >= 1 {
+		return img
+	}
+	b := img.Bounds()
+	w := max(int(float64(b.Dx())*scale), 1)
+	h := max(int(float64(b.Dy())*scale), 1)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+func encodeImage(img image.Image, opaque bool) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if !opaque {
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
@@ -0,0 +1,60 @@
+package gopilot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// pngWithSize encodes a 1x1 PNG whose header claims width x height.
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Signature (8), IHDR length (4), "IHDR" (4), width, height, ..., CRC.
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestFitImagePixelBudget(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height uint32
+		wantErr       string
+	}{
+		{"small", 1, 1, ""},
+		{"huge header", 60000, 60000, "over the limit"},
+		{"long strip", 50000001, 1, "over the limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := fitImage(pngWithSize(t, tt.width, tt.height))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("fitImage: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("fitImage error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadImageRemoteOffByDefault(t *testing.T) {
+	_, err := loadImage(context.Background(), "https://example.com/cat.png")
+	if err == nil || !strings.Contains(err.Error(), "off") {
+		t.Fatalf("loadImage error = %v, want remote fetch off", err)
+	}
+}